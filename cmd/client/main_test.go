@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/pubsubtest"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// game is a memory broker with the client topology of every player declared
+// and a key certified for each of them. Game logs are encrypted with keys
+// derived from logKeys, as the server does.
+type game struct {
+	conn    *pubsub.MemoryConnection
+	ch      pubsub.Channel
+	issuer  ed25519.PublicKey
+	keys    map[string]ed25519.PrivateKey
+	certs   map[string]pubsub.Certificate
+	logKeys pubsub.DerivedKeys
+}
+
+func newGame(t *testing.T, usernames ...string) *game {
+	t.Helper()
+	dir := t.TempDir()
+	issuer, err := pubsub.OpenKeyIssuer(filepath.Join(dir, "issuer.key"), filepath.Join(dir, "players.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := pubsub.OpenSecret(filepath.Join(dir, "logs.secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := pubsub.NewMemoryBroker().Connect()
+	g := &game{
+		conn:    conn,
+		issuer:  issuer.PublicKey(),
+		keys:    map[string]ed25519.PrivateKey{},
+		certs:   map[string]pubsub.Certificate{},
+		logKeys: secret,
+	}
+	for _, username := range append(usernames, "mallory") {
+		if err := routing.ClientTopology(username).Declare(conn); err != nil {
+			t.Fatal(err)
+		}
+		key, err := pubsub.OpenIdentity(filepath.Join(dir, username+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := issuer.Issue(username, key.Public().(ed25519.PublicKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.keys[username], g.certs[username] = key, cert
+	}
+	if g.ch, err = conn.Channel(); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func (g *game) sign(username string) pubsub.PublishOption {
+	return pubsub.SignedBy(g.keys[username], g.certs[username])
+}
+
+// encryptLog encrypts with the log key the server hands username.
+func (g *game) encryptLog(t *testing.T, username string) pubsub.PublishOption {
+	t.Helper()
+	key, err := g.logKeys.EncryptionKey(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubsub.WithEncryption(username, pubsub.StaticKeys{username: key})
+}
+
+type received[T any] struct {
+	value T
+	meta  pubsub.Metadata
+}
+
+// capture collects every message of topic in a queue of its own.
+func capture[T any](t *testing.T, g *game, topic pubsub.Topic[T]) <-chan received[T] {
+	t.Helper()
+	out := make(chan received[T], 10)
+	sub, err := topic.Subscribe(context.Background(), g.conn, "test."+t.Name(), pubsub.Transient,
+		func(_ context.Context, value T, meta pubsub.Metadata) (pubsub.AckType, error) {
+			out <- received[T]{value, meta}
+			return pubsub.Ack, nil
+		},
+		pubsub.WithVerifier(g.issuer),
+		pubsub.WithDecryption(g.logKeys),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return out
+}
+
+func expect[T any](t *testing.T, out <-chan received[T]) received[T] {
+	t.Helper()
+	select {
+	case r := <-out:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("nothing was published")
+		return received[T]{}
+	}
+}
+
+func expectNone[T any](t *testing.T, out <-chan received[T]) {
+	t.Helper()
+	select {
+	case r := <-out:
+		t.Fatalf("published %+v", r.value)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func playerWithUnitIn(username string, location gamelogic.Location) *gamelogic.GameState {
+	gs := gamelogic.NewGameState(username)
+	gs.CommandSpawn([]string{"spawn", string(location), string(gamelogic.RankInfantry)})
+	return gs
+}
+
+func TestHandlerArmyMove(t *testing.T) {
+	g := newGame(t, "alice", "bob")
+	bob := playerWithUnitIn("bob", "europe")
+	sub, err := gamelogic.ArmyMoves.Subscribe(context.Background(), g.conn,
+		routing.ArmyMovesQueuePrefix+".bob", pubsub.Transient,
+		handlerArmyMove(g.ch, bob, g.sign("bob")),
+		pubsub.WithVerifier(g.issuer),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	wars := capture(t, g, gamelogic.WarRecognitions)
+
+	alice := playerWithUnitIn("alice", "asia")
+	move, err := alice.CommandMove([]string{"move", "europe", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gamelogic.ArmyMoves.Publish(g.ch, pubsub.Params{"username": "alice"}, move, g.sign("alice")); err != nil {
+		t.Fatal(err)
+	}
+	war := expect(t, wars)
+	if war.value.Attacker.Username != "alice" || war.value.Defender.Username != "bob" {
+		t.Errorf("war = %+v, want alice attacking bob", war.value)
+	}
+	if war.meta.Sender != "bob" {
+		t.Errorf("war sent by %q, want the defender", war.meta.Sender)
+	}
+
+	safe, err := alice.CommandMove([]string{"move", "asia", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gamelogic.ArmyMoves.Publish(g.ch, pubsub.Params{"username": "alice"}, safe, g.sign("alice")); err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, wars)
+}
+
+func TestHandlerArmyMoveRejectsImpostors(t *testing.T) {
+	tests := []struct {
+		name string
+		sign func(g *game) pubsub.PublishOption
+	}{
+		{"signed as someone else", func(g *game) pubsub.PublishOption { return g.sign("mallory") }},
+		{"forged certificate", func(g *game) pubsub.PublishOption { return pubsub.SignedBy(g.keys["mallory"], g.certs["alice"]) }},
+		{"unsigned", func(g *game) pubsub.PublishOption { return pubsub.WithSender("alice") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGame(t, "alice", "bob")
+			bob := playerWithUnitIn("bob", "europe")
+			sub, err := gamelogic.ArmyMoves.Subscribe(context.Background(), g.conn,
+				routing.ArmyMovesQueuePrefix+".bob", pubsub.Transient,
+				handlerArmyMove(g.ch, bob, g.sign("bob")),
+				pubsub.WithVerifier(g.issuer),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			wars := capture(t, g, gamelogic.WarRecognitions)
+
+			move := gamelogic.ArmyMove{
+				Player:     playerWithUnitIn("alice", "europe").GetPlayerSnap(),
+				Units:      []gamelogic.Unit{{ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"}},
+				ToLocation: "europe",
+			}
+			if err := gamelogic.ArmyMoves.Publish(g.ch, pubsub.Params{"username": "alice"}, move, tt.sign(g)); err != nil {
+				t.Fatal(err)
+			}
+			dead := pubsubtest.Poll(t, g.conn.Channel, routing.DeadLetterQueue)
+			if dead.Headers[pubsub.HeaderErrorClass] != string(pubsub.ClassPermanent) {
+				t.Errorf("dead-lettered as %v: %v", dead.Headers[pubsub.HeaderErrorClass], dead.Headers[pubsub.HeaderDeadLetterReason])
+			}
+			expectNone(t, wars)
+		})
+	}
+}
+
+func TestHandlerWar(t *testing.T) {
+	g := newGame(t, "alice", "bob")
+	alice := playerWithUnitIn("alice", "europe")
+	sub, err := gamelogic.WarRecognitions.Subscribe(context.Background(), g.conn,
+		routing.WarQueue, pubsub.Quorum,
+		handlerWar(g.ch, alice, g.sign("alice"), g.encryptLog(t, "alice")),
+		pubsub.WithVerifier(g.issuer),
+		pubsub.WithRetry(routing.ClientRetryPolicy),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	logs := capture(t, g, routing.GameLogs)
+
+	war := gamelogic.RecognitionOfWar{
+		Attacker: alice.GetPlayerSnap(),
+		Defender: playerWithUnitIn("bob", "europe").GetPlayerSnap(),
+	}
+	if err := gamelogic.WarRecognitions.Publish(g.ch, pubsub.Params{"username": "bob"}, war, g.sign("bob"), pubsub.WithMessageID("war-1")); err != nil {
+		t.Fatal(err)
+	}
+	log := expect(t, logs)
+	if log.value.Username != "alice" || log.meta.Sender != "alice" {
+		t.Errorf("log %+v sent by %q, want alice's", log.value, log.meta.Sender)
+	}
+	if log.meta.RoutingKey != routing.GameLogSlug+".alice" {
+		t.Errorf("log routed to %q", log.meta.RoutingKey)
+	}
+	if log.meta.CausationID != "war-1" {
+		t.Errorf("log caused by %q, want the war", log.meta.CausationID)
+	}
+	if id := log.meta.Headers[pubsub.HeaderKeyID]; id != "alice" {
+		t.Errorf("log encrypted with key %v, want alice's", id)
+	}
+
+	// a war claiming to be recognised by someone other than its sender
+	if err := gamelogic.WarRecognitions.Publish(g.ch, pubsub.Params{"username": "bob"}, war, g.sign("mallory")); err != nil {
+		t.Fatal(err)
+	}
+	if dead := pubsubtest.Poll(t, g.conn.Channel, routing.DeadLetterQueue); dead.Headers[pubsub.HeaderErrorClass] != string(pubsub.ClassPermanent) {
+		t.Errorf("dead-lettered as %v", dead.Headers[pubsub.HeaderErrorClass])
+	}
+	expectNone(t, logs)
+}
+
+func TestHandlerWarSkipsOthersWars(t *testing.T) {
+	g := newGame(t, "alice", "bob", "carol")
+	carol := playerWithUnitIn("carol", "europe")
+	sub, err := gamelogic.WarRecognitions.Subscribe(context.Background(), g.conn,
+		routing.WarQueue, pubsub.Quorum,
+		handlerWar(g.ch, carol, g.sign("carol"), g.encryptLog(t, "carol")),
+		pubsub.WithVerifier(g.issuer),
+		pubsub.WithRetry(routing.ClientRetryPolicy),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	war := gamelogic.RecognitionOfWar{
+		Attacker: playerWithUnitIn("alice", "europe").GetPlayerSnap(),
+		Defender: playerWithUnitIn("bob", "europe").GetPlayerSnap(),
+	}
+	if err := gamelogic.WarRecognitions.Publish(g.ch, pubsub.Params{"username": "bob"}, war, g.sign("bob")); err != nil {
+		t.Fatal(err)
+	}
+	// held back for alice's client without using up an attempt
+	held := pubsubtest.Poll(t, g.conn.Channel, routing.ClientRetryPolicy.Queues(routing.WarQueue)[0])
+	if held.Headers[pubsub.HeaderSkips] != int64(1) || held.Headers[pubsub.HeaderAttempt] != nil {
+		t.Errorf("skipped war has headers %v", held.Headers)
+	}
+}
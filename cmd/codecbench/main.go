@@ -0,0 +1,102 @@
+// Command codecbench compares the payload size of the pubsub codecs on
+// representative game messages. Their encode and decode cost is measured by
+// the benchmarks: go test -bench . ./cmd/codecbench
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+var codecs = []pubsub.Codec{
+	pubsub.JSONCodec{},
+	pubsub.GobCodec{},
+	pubsub.ProtobufCodec{},
+	pubsub.MsgpackCodec{},
+}
+
+type sample struct {
+	name  string
+	value any
+}
+
+func main() {
+	units := flag.Int("units", 50, "number of units per player in the sample messages")
+	flag.Parse()
+
+	zenc, err := zstd.NewWriter(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "message\tcodec\tbytes\tgzip bytes\tzstd bytes\t")
+	for _, m := range samples(*units) {
+		for _, codec := range codecs {
+			data, err := codec.Marshal(m.value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s %s: %v\n", m.name, codec.ContentType(), err)
+				os.Exit(1)
+			}
+			gz, err := pubsub.GzipCompressor{}.Compress(data)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s %s gzip: %v\n", m.name, codec.ContentType(), err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t\n",
+				m.name,
+				codec.ContentType(),
+				len(data),
+				len(gz),
+				len(zenc.EncodeAll(data, nil)),
+			)
+		}
+	}
+	w.Flush()
+}
+
+// samples are the messages compared, with units units per player.
+func samples(units int) []sample {
+	attacker := samplePlayer("attacker", units)
+	defender := samplePlayer("defender", units)
+	return []sample{
+		{"PlayingState", routing.PlayingState{IsPaused: true}},
+		{"GameLog", routing.GameLog{
+			CurrentTime: time.Now().UTC(),
+			Message:     "attacker won a war against defender",
+			Username:    "attacker",
+		}},
+		{"ArmyMove", gamelogic.ArmyMove{
+			Player:     attacker,
+			Units:      []gamelogic.Unit{attacker.Units[1], attacker.Units[2]},
+			ToLocation: "asia",
+		}},
+		{"RecognitionOfWar", gamelogic.RecognitionOfWar{
+			Attacker: attacker,
+			Defender: defender,
+		}},
+	}
+}
+
+func samplePlayer(username string, units int) gamelogic.Player {
+	ranks := []gamelogic.UnitRank{gamelogic.RankInfantry, gamelogic.RankCavalry, gamelogic.RankArtillery}
+	locations := []gamelogic.Location{"americas", "europe", "africa", "asia", "australia", "antarctica"}
+	p := gamelogic.Player{Username: username, Units: map[int]gamelogic.Unit{}}
+	for id := 1; id <= units; id++ {
+		p.Units[id] = gamelogic.Unit{
+			ID:       id,
+			Rank:     ranks[id%len(ranks)],
+			Location: locations[id%len(locations)],
+		}
+	}
+	return p
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var benchUnits = flag.Int("units", 50, "number of units per player in the sample messages")
+
+func BenchmarkMarshal(b *testing.B) {
+	for _, m := range samples(*benchUnits) {
+		for _, codec := range codecs {
+			b.Run(m.name+"/"+strings.TrimPrefix(codec.ContentType(), "application/"), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := codec.Marshal(m.value); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	for _, m := range samples(*benchUnits) {
+		for _, codec := range codecs {
+			data, err := codec.Marshal(m.value)
+			if err != nil {
+				b.Fatal(err)
+			}
+			typ := reflect.TypeOf(m.value)
+			b.Run(m.name+"/"+strings.TrimPrefix(codec.ContentType(), "application/"), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					if err := codec.Unmarshal(data, reflect.New(typ).Interface()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// deadLetters is a memory broker whose dead-letter queue holds a move of
+// alice's that a subscriber rejected, then one of bob's the broker
+// dead-lettered. Both were published to moves.
+func deadLetters(t *testing.T) (*pubsub.MemoryConnection, pubsub.Channel) {
+	t.Helper()
+	conn := pubsub.NewMemoryBroker().Connect()
+	if err := routing.Exchanges().Declare(conn); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ch.Close() })
+
+	handled := make(chan struct{}, 1)
+	sub, err := pubsub.SubscribeHandler(context.Background(), conn, routing.ExchangePerilTopic, "moves", routing.ArmyMovesPrefix+".*", pubsub.Durable,
+		func(context.Context, gamelogic.ArmyMove, pubsub.Metadata) (pubsub.AckType, error) {
+			handled <- struct{}{}
+			return pubsub.Ack, pubsub.Permanent(errors.New("no such unit"))
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishMove(t, ch, "alice")
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("alice's move wasn't handled")
+	}
+	// closing waits for the move to be dead-lettered
+	sub.Close()
+
+	publishMove(t, ch, "bob")
+	msg, ok, err := ch.Get("moves", false)
+	if err != nil || !ok {
+		t.Fatalf("Get = %v, %v", ok, err)
+	}
+	if err := msg.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	return conn, ch
+}
+
+func publishMove(t *testing.T, ch pubsub.Channel, username string) {
+	t.Helper()
+	move := gamelogic.ArmyMove{Player: gamelogic.Player{Username: username}, ToLocation: gamelogic.Location("europe")}
+	if err := pubsub.Publish(ch, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+"."+username, pubsub.ContentTypeJSON, move); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func queued(t *testing.T, ch pubsub.Channel, queue string) int {
+	t.Helper()
+	q, err := ch.QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q.Messages
+}
+
+func TestList(t *testing.T) {
+	conn, ch := deadLetters(t)
+	var out strings.Builder
+	if err := list(&out, conn, routing.DeadLetterQueue); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`#1 exchange="peril_topic" key="army_moves.alice" content-type="application/json"`,
+		"rejected from moves (permanent): no such unit",
+		`#2 exchange="peril_topic" key="army_moves.bob"`,
+		"x-death: rejected from moves (count 1)",
+		"Username:bob",
+		"ToLocation:europe",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("list wrote %q, want it to contain %q", out.String(), want)
+		}
+	}
+	if n := queued(t, ch, routing.DeadLetterQueue); n != 2 {
+		t.Errorf("listing left %d messages, want 2", n)
+	}
+
+	purged := pubsub.NewMemoryBroker().Connect()
+	if err := routing.Exchanges().Declare(purged); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := list(&out, purged, routing.DeadLetterQueue); err != nil || out.String() != "No dead-lettered messages\n" {
+		t.Errorf("listing an empty queue wrote %q, %v", out.String(), err)
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	conn, ch := deadLetters(t)
+	// audit sees what reaches the moves' exchange from now on
+	if _, err := ch.QueueDeclare("audit", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("audit", routing.ArmyMovesPrefix+".*", routing.ExchangePerilTopic, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := requeue(&out, conn, routing.DeadLetterQueue, []string{"0"}); err == nil {
+		t.Error("requeued message 0")
+	}
+	if err := requeue(&out, conn, routing.DeadLetterQueue, []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Requeued 1 of 2 messages") {
+		t.Errorf("requeue wrote %q", out.String())
+	}
+	checkRequeued(t, ch, "bob")
+	if n := queued(t, ch, routing.DeadLetterQueue); n != 1 {
+		t.Errorf("%d messages left dead-lettered, want alice's", n)
+	}
+
+	// without numbers, every message is requeued
+	if err := requeue(&out, conn, routing.DeadLetterQueue, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRequeued(t, ch, "alice")
+	if n := queued(t, ch, routing.DeadLetterQueue); n != 0 {
+		t.Errorf("%d messages left dead-lettered", n)
+	}
+}
+
+// checkRequeued checks that username's move is back on its original route
+// as if it had just been published.
+func checkRequeued(t *testing.T, ch pubsub.Channel, username string) {
+	t.Helper()
+	msg, ok, err := ch.Get("audit", true)
+	if err != nil || !ok {
+		t.Fatalf("nothing was requeued: %v", err)
+	}
+	if msg.Exchange != routing.ExchangePerilTopic || msg.RoutingKey != routing.ArmyMovesPrefix+"."+username {
+		t.Errorf("requeued to %q with key %q", msg.Exchange, msg.RoutingKey)
+	}
+	for _, h := range []string{
+		"x-death",
+		"x-first-death-reason",
+		pubsub.HeaderDeadLetterReason,
+		pubsub.HeaderErrorClass,
+		pubsub.HeaderOriginalExchange,
+		pubsub.HeaderOriginalRoutingKey,
+		pubsub.HeaderOriginalQueue,
+	} {
+		if v, ok := msg.Headers[h]; ok {
+			t.Errorf("requeued with %s = %v", h, v)
+		}
+	}
+	move, err := pubsub.Decode[gamelogic.ArmyMove](msg)
+	if err != nil || move.Player.Username != username {
+		t.Errorf("requeued %+v, %v; want %s's move", move, err, username)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	conn, ch := deadLetters(t)
+	var out strings.Builder
+	if err := purge(&out, conn, routing.DeadLetterQueue); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Purged 2 messages from "+routing.DeadLetterQueue+"\n" {
+		t.Errorf("purge wrote %q", out.String())
+	}
+	if n := queued(t, ch, routing.DeadLetterQueue); n != 0 {
+		t.Errorf("%d messages left after purging", n)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestWriteSkipsLogsTheServerRefuses(t *testing.T) {
+	dir := t.TempDir()
+	issuerPath, secretPath := filepath.Join(dir, "peril.key"), filepath.Join(dir, "peril_logs.secret")
+	issuer, err := pubsub.OpenKeyIssuer(issuerPath, filepath.Join(dir, "peril_players.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := pubsub.OpenSecret(secretPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := map[string]pubsub.PublishOption{}
+	encrypters := map[string]pubsub.PublishOption{}
+	for _, username := range []string{"alice", "mallory"} {
+		key, err := pubsub.OpenIdentity(filepath.Join(dir, username+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := issuer.Issue(username, key.Public().(ed25519.PublicKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		logKey, err := pubsub.DerivedKeys(secret).EncryptionKey(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[username] = pubsub.SignedBy(key, cert)
+		encrypters[username] = pubsub.WithEncryption(username, pubsub.StaticKeys{username: logKey})
+	}
+
+	conn := pubsub.NewMemoryBroker().Connect()
+	if err := routing.ServerTopology().Declare(conn); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	logs := []struct {
+		route, username, message string
+		opts                     []pubsub.PublishOption
+	}{
+		{"alice", "alice", "genuine", []pubsub.PublishOption{signers["alice"], encrypters["alice"]}},
+		{"alice", "alice", "forged", []pubsub.PublishOption{signers["mallory"], encrypters["mallory"]}},
+		{"mallory", "alice", "misrouted", []pubsub.PublishOption{signers["mallory"], encrypters["mallory"]}},
+		{"alice", "alice", "unsigned", []pubsub.PublishOption{encrypters["alice"]}},
+		{"alice", "alice", "unencrypted", []pubsub.PublishOption{signers["alice"]}},
+	}
+	for _, l := range logs {
+		gl := routing.GameLog{CurrentTime: time.Now(), Username: l.username, Message: l.message}
+		if err := routing.GameLogs.Publish(ch, pubsub.Params{"username": l.route}, gl, l.opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := openChecker(issuerPath, secretPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := replay(conn, routing.GameLogStream, pubsub.OffsetFirst, 100*time.Millisecond, write(&out, c)); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 1 || !strings.HasSuffix(lines[0], "alice: genuine") {
+		t.Errorf("wrote %q, want only alice's genuine log", out.String())
+	}
+}
+
+func TestOpenCheckerNeedsTheServersKeys(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := openChecker(filepath.Join(dir, "peril.key"), filepath.Join(dir, "peril_logs.secret")); err == nil {
+		t.Error("opened a checker without the server's key")
+	}
+	if _, err := pubsub.OpenIdentity(filepath.Join(dir, "peril.key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openChecker(filepath.Join(dir, "peril.key"), filepath.Join(dir, "peril_logs.secret")); err == nil {
+		t.Error("opened a checker without the game log secret")
+	}
+}
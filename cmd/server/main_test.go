@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/pubsubtest"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestHandlerGameLog(t *testing.T) {
+	dir := t.TempDir()
+	issuer, err := pubsub.OpenKeyIssuer(filepath.Join(dir, "peril.key"), filepath.Join(dir, "peril_players.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := pubsub.OpenSecret(filepath.Join(dir, "peril_logs.secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logKeys := pubsub.DerivedKeys(secret)
+	playerKey := handlerPlayerKey(issuer, logKeys)
+	signers := map[string]pubsub.PublishOption{}
+	encrypters := map[string]pubsub.PublishOption{}
+	for _, username := range []string{"alice", "mallory"} {
+		key, err := pubsub.OpenIdentity(filepath.Join(dir, username+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, logKey := claimKey(t, playerKey, key, username)
+		signers[username] = pubsub.SignedBy(key, cert)
+		encrypters[username] = pubsub.WithEncryption(username, pubsub.StaticKeys{username: logKey})
+	}
+
+	conn := pubsub.NewMemoryBroker().Connect()
+	if err := routing.ServerTopology().Declare(conn); err != nil {
+		t.Fatal(err)
+	}
+	limiter := pubsub.NewRateLimiter(pubsub.RateLimit{Rate: 0.01, Burst: 2, Penalty: pubsub.PenaltyMute, MuteFor: time.Hour})
+	sub, err := routing.GameLogs.Subscribe(
+		context.Background(),
+		conn,
+		routing.GameLogStream,
+		pubsub.Stream,
+		handlerGameLog(filepath.Join(dir, "game.log")),
+		pubsub.WithVerifier(issuer.PublicKey()),
+		pubsub.WithDecryption(logKeys),
+		pubsub.WithRequiredEncryption(),
+		pubsub.WithQueueOptions(pubsub.WithMaxAge(routing.GameLogRetention)),
+		pubsub.WithStreamOffset(pubsub.OffsetFirst),
+		pubsub.WithPrefetch(10),
+		pubsub.WithWorkers(10),
+		pubsub.WithMiddleware(pubsub.RateLimited[routing.GameLog](limiter, verifiedSender)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(route, username, sender, message string, opts ...pubsub.PublishOption) {
+		t.Helper()
+		gl := routing.GameLog{CurrentTime: time.Now(), Username: username, Message: message}
+		opts = append(opts, signers[sender])
+		if err := routing.GameLogs.Publish(ch, pubsub.Params{"username": route}, gl, opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// mallory floods alice's logs, which would mute alice if the limit
+	// went by the routing key
+	publish("alice", "alice", "mallory", "forged", encrypters["mallory"])
+	publish("mallory", "alice", "mallory", "forged", encrypters["mallory"])
+	publish("alice", "alice", "mallory", "forged", encrypters["mallory"])
+	// logs anyone could have read on the way are refused
+	publish("alice", "alice", "alice", "unencrypted")
+	publish("alice", "alice", "alice", "genuine", encrypters["alice"])
+
+	var logs string
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		data, _ := os.ReadFile(filepath.Join(dir, "game.log"))
+		if logs = string(data); logs != "" {
+			break
+		}
+	}
+	if !strings.Contains(logs, "alice: genuine") || strings.Contains(logs, "forged") || strings.Contains(logs, "unencrypted") {
+		t.Errorf("wrote logs %q, want only alice's", logs)
+	}
+
+	// two forged and the unencrypted one; the third forged log is dropped
+	// while mallory is muted
+	for range 3 {
+		msg := pubsubtest.Poll(t, conn.Channel, routing.DeadLetterQueue)
+		if msg.Headers[pubsub.HeaderErrorClass] != string(pubsub.ClassPermanent) {
+			t.Errorf("log dead-lettered as %v", msg.Headers[pubsub.HeaderErrorClass])
+		}
+	}
+	if _, ok, _ := ch.Get(routing.DeadLetterQueue, true); ok {
+		t.Error("dead-lettered more than 3 logs")
+	}
+	for _, s := range limiter.Stats() {
+		if s.Key == "alice" && (s.Limited != 0 || !s.MutedUntil.IsZero()) {
+			t.Errorf("alice was limited for mallory's logs: %+v", s)
+		}
+	}
+}
+
+// claimKey asks playerKey to certify key for username as a client does,
+// returning the certificate and the log key it was sent.
+func claimKey(t *testing.T, playerKey func(routing.KeyRequest) (routing.PlayerKey, error), key ed25519.PrivateKey, username string) (pubsub.Certificate, []byte) {
+	t.Helper()
+	claim, sealKey, err := pubsub.NewKeyClaim(key, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := playerKey(routing.KeyRequest{Claim: claim})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logKey, err := claim.Open(sealKey, pk.LogKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pk.Certificate, logKey
+}
+
+func TestHandlerPlayerKey(t *testing.T) {
+	dir := t.TempDir()
+	issuer, err := pubsub.OpenKeyIssuer(filepath.Join(dir, "peril.key"), filepath.Join(dir, "peril_players.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logKeys := pubsub.DerivedKeys("a secret of at least thirty-two bytes")
+	playerKey := handlerPlayerKey(issuer, logKeys)
+
+	alice, err := pubsub.OpenIdentity(filepath.Join(dir, "alice.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := pubsub.OpenIdentity(filepath.Join(dir, "mallory.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceClaim, _, err := pubsub.NewKeyClaim(alice, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := playerKey(routing.KeyRequest{Claim: aliceClaim})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, logKey := claimKey(t, playerKey, alice, "alice")
+	if want, _ := logKeys.EncryptionKey("alice"); !bytes.Equal(logKey, want) {
+		t.Errorf("alice was given log key %x, want %x", logKey, want)
+	}
+
+	// alice's public key goes out in every certificate, so mallory can
+	// copy it into a claim of her own, but can't sign for it
+	replayed, malloryKey, err := pubsub.NewKeyClaim(mallory, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed.PublicKey = alice.Public().(ed25519.PublicKey)
+	if pk, err := playerKey(routing.KeyRequest{Claim: replayed}); !errors.Is(err, pubsub.ErrBadClaim) || len(pk.LogKey) != 0 {
+		t.Errorf("replayed public key was given log key %x, err %v", pk.LogKey, err)
+	}
+
+	// resending alice's whole claim gets a log key only alice can open
+	if _, err := aliceClaim.Open(malloryKey, pk.LogKey); err == nil {
+		t.Error("mallory opened the log key sealed to alice's claim")
+	}
+
+	// signing for her own key under alice's username gets her nothing
+	claim, _, err := pubsub.NewKeyClaim(mallory, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk, err := playerKey(routing.KeyRequest{Claim: claim}); err == nil || len(pk.LogKey) != 0 {
+		t.Errorf("mallory was given alice's log key %x, err %v", pk.LogKey, err)
+	}
+}
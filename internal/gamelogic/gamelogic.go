@@ -33,6 +33,10 @@ func ClientWelcome() (string, error) {
 		return "", errors.New("you must enter a username. goodbye")
 	}
 	username := words[0]
+	// usernames are words of routing keys
+	if strings.ContainsAny(username, ".*#") {
+		return "", errors.New("usernames can't contain '.', '*' or '#'. goodbye")
+	}
 	fmt.Printf("Welcome, %s!\n", username)
 	PrintClientHelp()
 	return username, nil
@@ -42,6 +46,7 @@ func PrintServerHelp() {
 	fmt.Println("Possible commands:")
 	fmt.Println("* pause")
 	fmt.Println("* resume")
+	fmt.Println("* limits")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
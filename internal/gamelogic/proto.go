@@ -0,0 +1,124 @@
+package gamelogic
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/protoutil"
+)
+
+// Protocol Buffers encoding of the messages in gamelogic.proto.
+
+func (u Unit) MarshalProto() ([]byte, error) {
+	return u.appendProto(nil), nil
+}
+
+func (u Unit) appendProto(b []byte) []byte {
+	b = protoutil.AppendInt64(b, 1, int64(u.ID))
+	b = protoutil.AppendString(b, 2, string(u.Rank))
+	b = protoutil.AppendString(b, 3, string(u.Location))
+	return b
+}
+
+func (u *Unit) UnmarshalProto(b []byte) error {
+	*u = Unit{}
+	return protoutil.Range(b, func(f protoutil.Field) error {
+		switch f.Num {
+		case 1:
+			u.ID = int(int64(f.Varint))
+		case 2:
+			u.Rank = UnitRank(f.Bytes)
+		case 3:
+			u.Location = Location(f.Bytes)
+		}
+		return nil
+	})
+}
+
+func (p Player) MarshalProto() ([]byte, error) {
+	return p.appendProto(nil), nil
+}
+
+func (p Player) appendProto(b []byte) []byte {
+	b = protoutil.AppendString(b, 1, p.Username)
+	for id, unit := range p.Units {
+		var entry []byte
+		entry = protoutil.AppendInt64(entry, 1, int64(id))
+		entry = protoutil.AppendMessage(entry, 2, unit.appendProto(nil))
+		b = protoutil.AppendMessage(b, 2, entry)
+	}
+	return b
+}
+
+func (p *Player) UnmarshalProto(b []byte) error {
+	*p = Player{Units: map[int]Unit{}}
+	return protoutil.Range(b, func(f protoutil.Field) error {
+		switch f.Num {
+		case 1:
+			p.Username = string(f.Bytes)
+		case 2:
+			var id int
+			var unit Unit
+			err := protoutil.Range(f.Bytes, func(f protoutil.Field) error {
+				switch f.Num {
+				case 1:
+					id = int(int64(f.Varint))
+				case 2:
+					return unit.UnmarshalProto(f.Bytes)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			p.Units[id] = unit
+		}
+		return nil
+	})
+}
+
+func (am ArmyMove) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = protoutil.AppendMessage(b, 1, am.Player.appendProto(nil))
+	for _, unit := range am.Units {
+		b = protoutil.AppendMessage(b, 2, unit.appendProto(nil))
+	}
+	b = protoutil.AppendString(b, 3, string(am.ToLocation))
+	return b, nil
+}
+
+func (am *ArmyMove) UnmarshalProto(b []byte) error {
+	*am = ArmyMove{}
+	return protoutil.Range(b, func(f protoutil.Field) error {
+		switch f.Num {
+		case 1:
+			return am.Player.UnmarshalProto(f.Bytes)
+		case 2:
+			var unit Unit
+			if err := unit.UnmarshalProto(f.Bytes); err != nil {
+				return err
+			}
+			am.Units = append(am.Units, unit)
+		case 3:
+			am.ToLocation = Location(f.Bytes)
+		}
+		return nil
+	})
+}
+
+func (rw RecognitionOfWar) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = protoutil.AppendMessage(b, 1, rw.Attacker.appendProto(nil))
+	b = protoutil.AppendMessage(b, 2, rw.Defender.appendProto(nil))
+	return b, nil
+}
+
+func (rw *RecognitionOfWar) UnmarshalProto(b []byte) error {
+	*rw = RecognitionOfWar{}
+	return protoutil.Range(b, func(f protoutil.Field) error {
+		switch f.Num {
+		case 1:
+			return rw.Attacker.UnmarshalProto(f.Bytes)
+		case 2:
+			return rw.Defender.UnmarshalProto(f.Bytes)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,11 @@
+package gamelogic
+
+import "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+
+// Schema versions of the messages clients send each other. A message that
+// changes shape needs a new version here and a pubsub.Upcast from its
+// previous definition.
+func init() {
+	pubsub.RegisterSchema[ArmyMove](pubsub.DefaultSchemas, 1)
+	pubsub.RegisterSchema[RecognitionOfWar](pubsub.DefaultSchemas, 1)
+}
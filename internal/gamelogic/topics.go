@@ -0,0 +1,21 @@
+package gamelogic
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// Topics of the messages clients send each other, keyed by the username of
+// the player who moved or whose move started the war.
+var (
+	ArmyMoves = pubsub.Topic[ArmyMove]{
+		Exchange:    routing.ExchangePerilTopic,
+		Key:         routing.ArmyMovesPrefix + ".{username}",
+		ContentType: pubsub.ContentTypeJSON,
+	}
+	WarRecognitions = pubsub.Topic[RecognitionOfWar]{
+		Exchange:    routing.ExchangePerilTopic,
+		Key:         routing.WarRecognitionsPrefix + ".{username}",
+		ContentType: pubsub.ContentTypeJSON,
+	}
+)
@@ -0,0 +1,109 @@
+// Package protoutil has helpers for hand-written Protocol Buffers encodings
+// of the game's message types.
+package protoutil
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field is one decoded field of a message. Varint holds varint values and
+// Bytes holds length-delimited ones.
+type Field struct {
+	Num    protowire.Number
+	Type   protowire.Type
+	Varint uint64
+	Bytes  []byte
+}
+
+// Range calls fn for each field in the encoded message b. Fields of other
+// wire types are skipped.
+func Range(b []byte, fn func(Field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := Field{Num: num, Type: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.Varint, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.Bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The Append functions omit proto3 default values, except AppendMessage
+// which always records the field's presence.
+
+func AppendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func AppendInt64(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func AppendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeBool(v))
+}
+
+func AppendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// AppendTimestamp encodes t as a google.protobuf.Timestamp.
+func AppendTimestamp(b []byte, num protowire.Number, t time.Time) []byte {
+	var ts []byte
+	ts = AppendInt64(ts, 1, t.Unix())
+	ts = AppendInt64(ts, 2, int64(t.Nanosecond()))
+	return AppendMessage(b, num, ts)
+}
+
+func ParseTimestamp(b []byte) (time.Time, error) {
+	var seconds, nanos int64
+	err := Range(b, func(f Field) error {
+		switch f.Num {
+		case 1:
+			seconds = int64(f.Varint)
+		case 2:
+			nanos = int64(f.Varint)
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, nanos).UTC(), nil
+}
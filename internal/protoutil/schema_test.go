@@ -0,0 +1,375 @@
+package protoutil_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// The hand-written encodings are checked against the .proto files they
+// claim to implement: what they write must decode under the schema with no
+// unknown fields and mean what the golden file says, and what the schema
+// writes for the golden file must decode back to the same value.
+func TestSchemas(t *testing.T) {
+	gamelogicProto := loadProto(t, "../gamelogic/gamelogic.proto")
+	routingProto := loadProto(t, "../routing/routing.proto")
+
+	alice := gamelogic.Player{Username: "alice", Units: map[int]gamelogic.Unit{
+		1: {ID: 1, Rank: gamelogic.RankInfantry, Location: "europe"},
+		2: {ID: 2, Rank: gamelogic.RankArtillery, Location: "asia"},
+	}}
+	bob := gamelogic.Player{Username: "bob", Units: map[int]gamelogic.Unit{
+		7: {ID: 7, Rank: gamelogic.RankCavalry, Location: "europe"},
+	}}
+	tests := []struct {
+		file  protoreflect.FileDescriptor
+		name  protoreflect.Name
+		value any
+	}{
+		{gamelogicProto, "Unit", &gamelogic.Unit{ID: 3, Rank: gamelogic.RankCavalry, Location: "africa"}},
+		{gamelogicProto, "Player", &alice},
+		{gamelogicProto, "ArmyMove", &gamelogic.ArmyMove{
+			Player:     alice,
+			Units:      []gamelogic.Unit{alice.Units[2], alice.Units[1]},
+			ToLocation: "antarctica",
+		}},
+		{gamelogicProto, "RecognitionOfWar", &gamelogic.RecognitionOfWar{Attacker: alice, Defender: bob}},
+		{routingProto, "PlayingState", &routing.PlayingState{IsPaused: true}},
+		{routingProto, "GameLog", &routing.GameLog{
+			CurrentTime: time.Date(2024, 3, 1, 12, 30, 0, 500, time.UTC),
+			Message:     "alice won a war against bob",
+			Username:    "alice",
+		}},
+	}
+	covered := map[protoreflect.FullName]bool{}
+	for _, tt := range tests {
+		desc := tt.file.Messages().ByName(tt.name)
+		if desc == nil {
+			t.Fatalf("%s has no message %s", tt.file.Path(), tt.name)
+		}
+		covered[desc.FullName()] = true
+	}
+	for _, file := range []protoreflect.FileDescriptor{gamelogicProto, routingProto} {
+		for i := 0; i < file.Messages().Len(); i++ {
+			if name := file.Messages().Get(i).FullName(); !covered[name] {
+				t.Errorf("%s has no test case", name)
+			}
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.name), func(t *testing.T) {
+			desc := tt.file.Messages().ByName(tt.name)
+			golden := filepath.Join("testdata", string(tt.name)+".json")
+
+			data, err := pubsub.ProtobufCodec{}.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written := dynamicpb.NewMessage(desc)
+			if err := proto.Unmarshal(data, written); err != nil {
+				t.Fatalf("schema can't decode the hand-written encoding: %v", err)
+			}
+			assertNoUnknown(t, written.ProtoReflect())
+			got, err := protojson.Marshal(written)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *update {
+				var indented bytes.Buffer
+				if err := json.Indent(&indented, got, "", "  "); err != nil {
+					t.Fatal(err)
+				}
+				indented.WriteByte('\n')
+				if err := os.WriteFile(golden, indented.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSameJSON(t, got, want)
+
+			fromSchema := dynamicpb.NewMessage(desc)
+			if err := protojson.Unmarshal(want, fromSchema); err != nil {
+				t.Fatal(err)
+			}
+			encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(fromSchema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := reflect.New(reflect.TypeOf(tt.value).Elem()).Interface()
+			if err := (pubsub.ProtobufCodec{}).Unmarshal(encoded, decoded); err != nil {
+				t.Fatalf("can't decode the schema's encoding: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, tt.value) {
+				t.Errorf("decoded the schema's encoding as %+v, want %+v", decoded, tt.value)
+			}
+		})
+	}
+}
+
+func assertNoUnknown(t *testing.T, m protoreflect.Message) {
+	t.Helper()
+	if len(m.GetUnknown()) > 0 {
+		t.Errorf("%s has fields the schema doesn't know", m.Descriptor().FullName())
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+					assertNoUnknown(t, v.Message())
+					return true
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				for i := 0; i < v.List().Len(); i++ {
+					assertNoUnknown(t, v.List().Get(i).Message())
+				}
+			}
+		case fd.Message() != nil:
+			assertNoUnknown(t, v.Message())
+		}
+		return true
+	})
+}
+
+func assertSameJSON(t *testing.T, got, want []byte) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(want, &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("hand-written encoding reads under the schema as\n%s\nwant\n%s\n(run with -update if the change is intended)", got, want)
+	}
+}
+
+// loadProto builds the descriptor for a .proto file. It understands the
+// subset of proto3 the game's schemas use: imports, options, and messages of
+// scalar, message, repeated and map fields.
+func loadProto(t *testing.T, path string) protoreflect.FileDescriptor {
+	t.Helper()
+	src, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := parseProto(filepath.Base(path), string(src))
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	file, err := protodesc.NewFile(fd, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return file
+}
+
+var (
+	protoComment = regexp.MustCompile(`//.*`)
+	protoToken   = regexp.MustCompile(`[A-Za-z_][\w.]*|\d+|"[^"]*"|[{}<>=;,]`)
+)
+
+var protoScalars = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"uint32": descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	"uint64": descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+}
+
+type protoParser struct {
+	tokens []string
+	pkg    string
+}
+
+func (p *protoParser) next() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	tok := p.tokens[0]
+	p.tokens = p.tokens[1:]
+	return tok
+}
+
+func (p *protoParser) expect(want string) error {
+	if got := p.next(); got != want {
+		return fmt.Errorf("expected %q, got %q", want, got)
+	}
+	return nil
+}
+
+func parseProto(name, src string) (*descriptorpb.FileDescriptorProto, error) {
+	p := &protoParser{tokens: protoToken.FindAllString(protoComment.ReplaceAllString(src, ""), -1)}
+	fd := &descriptorpb.FileDescriptorProto{Name: proto.String(name)}
+	for len(p.tokens) > 0 {
+		switch tok := p.next(); tok {
+		case "syntax":
+			p.next()
+			fd.Syntax = proto.String(strings.Trim(p.next(), `"`))
+		case "package":
+			p.pkg = p.next()
+			fd.Package = proto.String(p.pkg)
+		case "import":
+			fd.Dependency = append(fd.Dependency, strings.Trim(p.next(), `"`))
+		case "option":
+			for len(p.tokens) > 0 && p.tokens[0] != ";" {
+				p.next()
+			}
+		case "message":
+			msg, err := p.message()
+			if err != nil {
+				return nil, err
+			}
+			fd.MessageType = append(fd.MessageType, msg)
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected %q", tok)
+		}
+		if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+	}
+	return fd, nil
+}
+
+func (p *protoParser) message() (*descriptorpb.DescriptorProto, error) {
+	msg := &descriptorpb.DescriptorProto{Name: proto.String(p.next())}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for len(p.tokens) > 0 && p.tokens[0] != "}" {
+		field := &descriptorpb.FieldDescriptorProto{
+			Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		typ := p.next()
+		switch typ {
+		case "repeated":
+			field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			typ = p.next()
+		case "map":
+			p.next()
+			key := p.next()
+			p.next()
+			value := p.next()
+			if err := p.expect(">"); err != nil {
+				return nil, err
+			}
+			entry, err := p.mapEntry(p.tokens[0], key, value)
+			if err != nil {
+				return nil, err
+			}
+			msg.NestedType = append(msg.NestedType, entry)
+			field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+			typ = "." + p.pkg + "." + msg.GetName() + "." + entry.GetName()
+		}
+		if err := p.setType(field, typ); err != nil {
+			return nil, err
+		}
+		field.Name = proto.String(p.next())
+		field.JsonName = proto.String(protoJSONName(field.GetName()))
+		if err := p.expect("="); err != nil {
+			return nil, err
+		}
+		num, err := strconv.Atoi(p.next())
+		if err != nil {
+			return nil, err
+		}
+		field.Number = proto.Int32(int32(num))
+		if err := p.expect(";"); err != nil {
+			return nil, err
+		}
+		msg.Field = append(msg.Field, field)
+	}
+	return msg, p.expect("}")
+}
+
+func (p *protoParser) mapEntry(field, key, value string) (*descriptorpb.DescriptorProto, error) {
+	entry := &descriptorpb.DescriptorProto{
+		Name:    proto.String(protoJSONName("_"+field) + "Entry"),
+		Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+	}
+	for i, typ := range []string{key, value} {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String([]string{"key", "value"}[i]),
+			Number: proto.Int32(int32(i + 1)),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		f.JsonName = proto.String(f.GetName())
+		if err := p.setType(f, typ); err != nil {
+			return nil, err
+		}
+		entry.Field = append(entry.Field, f)
+	}
+	return entry, nil
+}
+
+func (p *protoParser) setType(field *descriptorpb.FieldDescriptorProto, typ string) error {
+	if scalar, ok := protoScalars[typ]; ok {
+		field.Type = scalar.Enum()
+		return nil
+	}
+	if typ == "" || !protoToken.MatchString(typ) {
+		return fmt.Errorf("bad type %q", typ)
+	}
+	field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+	switch {
+	case strings.HasPrefix(typ, "."):
+		field.TypeName = proto.String(typ)
+	case strings.Contains(typ, "."):
+		field.TypeName = proto.String("." + typ)
+	default:
+		field.TypeName = proto.String("." + p.pkg + "." + typ)
+	}
+	return nil
+}
+
+// protoJSONName is the lowerCamelCase JSON name protoc gives a field.
+func protoJSONName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = []rune(strings.ToUpper(string(r)))[0]
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publisher publishes a message to an exchange. *amqp.Channel satisfies it.
+type Publisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Consumer receives deliveries from a queue. *amqp.Channel satisfies it.
+type Consumer interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+}
+
+// Channel is the subset of an AMQP channel used by this package.
+type Channel interface {
+	Publisher
+	Consumer
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+	QueuePurge(name string, noWait bool) (int, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Close() error
+}
+
+// Broker is a connection to a message broker that hands out channels.
+type Broker interface {
+	Channel() (Channel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+var _ Channel = (*amqp.Channel)(nil)
+
+// RabbitBroker is a Broker backed by a RabbitMQ connection.
+type RabbitBroker struct {
+	conn *amqp.Connection
+}
+
+func Dial(url string) (*RabbitBroker, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return NewRabbitBroker(conn), nil
+}
+
+func NewRabbitBroker(conn *amqp.Connection) *RabbitBroker {
+	return &RabbitBroker{conn: conn}
+}
+
+func (b *RabbitBroker) Channel() (Channel, error) {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (b *RabbitBroker) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	return b.conn.NotifyClose(receiver)
+}
+
+func (b *RabbitBroker) Close() error {
+	return b.conn.Close()
+}
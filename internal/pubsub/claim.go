@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrBadClaim   = errors.New("key claim is not signed by the key it claims")
+	ErrStaleClaim = errors.New("key claim is too old")
+)
+
+// KeyClaim asks a KeyIssuer to certify PublicKey for Sender. It is signed
+// with the private half of PublicKey, so the one asking must hold it rather
+// than having copied the public key out of a certificate. SealKey is a
+// one-off X25519 key that secrets sent back are sealed to, so replaying a
+// claim gets nothing the replayer can read.
+type KeyClaim struct {
+	Sender    string
+	PublicKey ed25519.PublicKey
+	SealKey   []byte
+	Time      time.Time
+	Signature []byte
+}
+
+// NewKeyClaim claims key for sender. The returned key opens what is sealed
+// to the claim.
+func NewKeyClaim(key ed25519.PrivateKey, sender string) (KeyClaim, *ecdh.PrivateKey, error) {
+	seal, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return KeyClaim{}, nil, err
+	}
+	c := KeyClaim{
+		Sender:    sender,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		SealKey:   seal.PublicKey().Bytes(),
+		Time:      time.Now(),
+	}
+	c.Signature = ed25519.Sign(key, c.signed())
+	return c, seal, nil
+}
+
+func (c KeyClaim) signed() []byte {
+	return appendFields([]byte("peril key claim\x00"),
+		c.Sender,
+		string(c.PublicKey),
+		string(c.SealKey),
+		strconv.FormatInt(c.Time.Unix(), 10),
+	)
+}
+
+// Verify checks that c was signed by the key it claims, within maxAge of
+// now either way, as clocks disagree.
+func (c KeyClaim) Verify(maxAge time.Duration) error {
+	if len(c.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(c.PublicKey, c.signed(), c.Signature) {
+		return ErrBadClaim
+	}
+	if age := time.Since(c.Time); age > maxAge || age < -maxAge {
+		return fmt.Errorf("%w: made %s ago", ErrStaleClaim, age.Round(time.Second))
+	}
+	return nil
+}
+
+// Seal encrypts secret so only the holder of c's SealKey can read it.
+func (c KeyClaim) Seal(secret []byte) ([]byte, error) {
+	peer, err := ecdh.X25519().NewPublicKey(c.SealKey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed seal key: %w", err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealAEAD(ephemeral, peer, ephemeral.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(ephemeral.PublicKey().Bytes(), nonce...)
+	return aead.Seal(out, nonce, secret, c.Signature), nil
+}
+
+// Open reads what was sealed to c, with the key NewKeyClaim returned.
+func (c KeyClaim) Open(key *ecdh.PrivateKey, sealed []byte) ([]byte, error) {
+	size := len(key.PublicKey().Bytes())
+	if len(sealed) < size {
+		return nil, errors.New("sealed secret is too short")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[:size])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealAEAD(key, ephemeral, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	rest := sealed[size:]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("sealed secret is too short")
+	}
+	secret, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], c.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("could not open sealed secret: %w", err)
+	}
+	return secret, nil
+}
+
+// sealAEAD keys AES-GCM with the secret key and peer share, bound to the
+// ephemeral key the sealer sent.
+func sealAEAD(key *ecdh.PrivateKey, peer, ephemeral *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := key.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(appendFields([]byte("peril seal\x00"), string(shared), string(ephemeral.Bytes())))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,93 @@
+package pubsub
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestKeyClaimVerify(t *testing.T) {
+	alice, mallory := newTestKey(t), newTestKey(t)
+	// resign makes a claim alice signed at another time
+	resign := func(c *KeyClaim, at time.Time) {
+		c.Time = at
+		c.Signature = ed25519.Sign(alice, c.signed())
+	}
+	tests := []struct {
+		name   string
+		change func(*KeyClaim)
+		want   error
+	}{
+		{"genuine", func(*KeyClaim) {}, nil},
+		{"another's public key", func(c *KeyClaim) { c.PublicKey = mallory.Public().(ed25519.PublicKey) }, ErrBadClaim},
+		{"sender", func(c *KeyClaim) { c.Sender = "mallory" }, ErrBadClaim},
+		{"seal key", func(c *KeyClaim) { c.SealKey = bytes.Repeat([]byte{1}, 32) }, ErrBadClaim},
+		{"time", func(c *KeyClaim) { c.Time = c.Time.Add(-time.Hour) }, ErrBadClaim},
+		{"malformed public key", func(c *KeyClaim) { c.PublicKey = c.PublicKey[:8] }, ErrBadClaim},
+		{"old", func(c *KeyClaim) { resign(c, time.Now().Add(-time.Hour)) }, ErrStaleClaim},
+		{"from the future", func(c *KeyClaim) { resign(c, time.Now().Add(time.Hour)) }, ErrStaleClaim},
+		{"slightly behind", func(c *KeyClaim) { resign(c, time.Now().Add(-time.Minute)) }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claim, _, err := NewKeyClaim(alice, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(&claim)
+			if err := claim.Verify(5 * time.Minute); !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyClaimSeal(t *testing.T) {
+	claim, sealKey, err := NewKeyClaim(newTestKey(t), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("alice's log key")
+	sealed, err := claim.Seal(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, secret) {
+		t.Error("the secret was sealed in the clear")
+	}
+	if got, err := claim.Open(sealKey, sealed); err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("opened %q, %v; want %q", got, err, secret)
+	}
+
+	other, otherKey, err := NewKeyClaim(newTestKey(t), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := claim.Open(otherKey, sealed); err == nil {
+		t.Error("opened with another claim's key")
+	}
+	// sealed to one claim, it can't be passed off as the answer to another
+	if _, err := other.Open(sealKey, sealed); err == nil {
+		t.Error("opened as the answer to another claim")
+	}
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := claim.Open(sealKey, tampered); err == nil {
+		t.Error("opened a tampered secret")
+	}
+	if _, err := claim.Open(sealKey, sealed[:10]); err == nil {
+		t.Error("opened a truncated secret")
+	}
+}
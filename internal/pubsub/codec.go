@@ -0,0 +1,135 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"reflect"
+	"sync"
+)
+
+// Codec encodes and decodes message bodies of one content type.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// CodecRegistry looks up codecs by the ContentType of a message.
+type CodecRegistry struct {
+	mu     sync.RWMutex
+	codecs map[string]Codec
+}
+
+func NewCodecRegistry(codecs ...Codec) *CodecRegistry {
+	r := &CodecRegistry{codecs: map[string]Codec{}}
+	for _, c := range codecs {
+		r.Register(c)
+	}
+	return r
+}
+
+func (r *CodecRegistry) Register(c Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codecs[c.ContentType()] = c
+}
+
+// Lookup finds the codec for contentType, ignoring parameters such as
+// charset.
+func (r *CodecRegistry) Lookup(contentType string) (Codec, bool) {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.codecs[contentType]
+	return c, ok
+}
+
+// DefaultCodecs is used by Publish and by subscriptions that don't set
+// WithCodecs.
+var DefaultCodecs = NewCodecRegistry(
+	JSONCodec{},
+	GobCodec{},
+	ProtobufCodec{},
+	MsgpackCodec{},
+	TextCodec{},
+)
+
+func RegisterCodec(c Codec) {
+	DefaultCodecs.Register(c)
+}
+
+// Publish encodes value with the default codec for contentType and sends it
+// in an envelope with a new message ID, the current time, value's type and
+// its schema version in DefaultSchemas.
+func Publish[T any](pub Publisher, exchange, key, contentType string, value T, opts ...PublishOption) error {
+	msg, err := newPublishing(contentType, value, opts)
+	if err != nil {
+		return err
+	}
+	return pub.PublishWithContext(
+		context.Background(),
+		exchange,
+		key,
+		msg.mandatory,
+		false,
+		msg.Publishing,
+	)
+}
+
+func newPublishing[T any](contentType string, value T, opts []PublishOption) (publishing, error) {
+	codec, ok := DefaultCodecs.Lookup(contentType)
+	if !ok {
+		return publishing{}, fmt.Errorf("no codec registered for content type %q", contentType)
+	}
+	body, err := codec.Marshal(value)
+	if err != nil {
+		return publishing{}, err
+	}
+
+	msg := envelope(value, opts)
+	msg.Headers[HeaderSchemaVersion] = int64(DefaultSchemas.Version(reflect.TypeFor[T]()))
+	msg.ContentType = codec.ContentType()
+	msg.Body = body
+	if err := msg.compress(); err != nil {
+		return publishing{}, err
+	}
+	if err := msg.encrypt(); err != nil {
+		return publishing{}, err
+	}
+	msg.sign()
+	return msg, nil
+}
+
+// TextCodec handles text/plain bodies decoded into a string or []byte.
+type TextCodec struct{}
+
+func (TextCodec) ContentType() string {
+	return "text/plain"
+}
+
+func (TextCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case fmt.Stringer:
+		return []byte(v.String()), nil
+	}
+	return nil, fmt.Errorf("text/plain can't encode %T", v)
+}
+
+func (TextCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *string:
+		*v = string(data)
+	case *[]byte:
+		*v = append([]byte(nil), data...)
+	default:
+		return fmt.Errorf("text/plain can't decode into %T", v)
+	}
+	return nil
+}
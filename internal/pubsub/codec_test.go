@@ -0,0 +1,58 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/pubsubtest"
+)
+
+func TestUnknownContentTypeIsDeadLettered(t *testing.T) {
+	conn := NewMemoryBroker().Connect()
+	if err := DeadLetterTopology("dead").Declare(conn); err != nil {
+		t.Fatal(err)
+	}
+	handled := make(chan note, 1)
+	sub, err := SubscribeHandler(context.Background(), conn, "amq.direct", "notes", "note", Durable,
+		func(_ context.Context, n note, _ Metadata) (AckType, error) {
+			handled <- n
+			return Ack, nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ch := memChannelOf(t, conn.broker)
+	err = ch.PublishWithContext(context.Background(), "amq.direct", "note", false, false, amqp.Publishing{
+		ContentType: "application/x-peril-unknown",
+		Body:        []byte("hello"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dead := pubsubtest.Poll(t, conn.Channel, "dead")
+	if reason := dead.Headers[HeaderDeadLetterReason]; reason != `unsupported content type "application/x-peril-unknown"` {
+		t.Errorf("dead-lettered because %v", reason)
+	}
+	if dead.Headers[HeaderErrorClass] != string(ClassPermanent) {
+		t.Errorf("dead-lettered as %v", dead.Headers[HeaderErrorClass])
+	}
+	// it is settled once, not nacked back onto the queue
+	time.Sleep(20 * time.Millisecond)
+	if q, err := ch.QueueDeclarePassive("notes", true, false, false, false, nil); err != nil || q.Messages != 0 {
+		t.Errorf("notes holds %d messages, %v", q.Messages, err)
+	}
+	if _, ok, _ := ch.Get("dead", true); ok {
+		t.Error("dead-lettered more than once")
+	}
+	select {
+	case n := <-handled:
+		t.Errorf("handled %+v", n)
+	default:
+	}
+}
@@ -0,0 +1,164 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Content encodings for WithCompression.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// DefaultCompressionThreshold is a body size below which compressing rarely
+// pays off.
+const DefaultCompressionThreshold = 1024
+
+// maxDecompressedSize bounds how large a compressed body may expand.
+const maxDecompressedSize = 64 << 20
+
+// Compressor compresses message bodies for one content encoding.
+type Compressor interface {
+	Encoding() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(GzipCompressor{})
+	RegisterCompressor(newZstdCompressor())
+}
+
+// RegisterCompressor makes c available to WithCompression and to
+// subscriptions receiving messages in its encoding.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Encoding()] = c
+}
+
+func lookupCompressor(encoding string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[encoding]
+	return c, ok
+}
+
+// WithCompression compresses the body with encoding when it is at least
+// threshold bytes, setting the message's ContentEncoding. Subscriptions
+// decompress it before decoding.
+func WithCompression(encoding string, threshold int) PublishOption {
+	return func(p *publishing) {
+		p.compression = encoding
+		p.compressAbove = threshold
+	}
+}
+
+// compress applies the compression p asked for, if its body is big enough.
+func (p *publishing) compress() error {
+	if p.compression == "" || len(p.Body) < p.compressAbove {
+		return nil
+	}
+	c, ok := lookupCompressor(p.compression)
+	if !ok {
+		return fmt.Errorf("no compressor registered for content encoding %q", p.compression)
+	}
+	body, err := c.Compress(p.Body)
+	if err != nil {
+		return fmt.Errorf("could not compress with %s: %w", p.compression, err)
+	}
+	p.Body, p.ContentEncoding = body, c.Encoding()
+	return nil
+}
+
+// Decompress returns the body of msg without its content encoding.
+func Decompress(msg amqp.Delivery) ([]byte, error) {
+	if msg.ContentEncoding == "" || msg.ContentEncoding == "identity" {
+		return msg.Body, nil
+	}
+	c, ok := lookupCompressor(msg.ContentEncoding)
+	if !ok {
+		return nil, fmt.Errorf("unsupported content encoding %q", msg.ContentEncoding)
+	}
+	body, err := c.Decompress(msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress %s body: %w", msg.ContentEncoding, err)
+	}
+	return body, nil
+}
+
+type GzipCompressor struct{}
+
+func (GzipCompressor) Encoding() string {
+	return EncodingGzip
+}
+
+func (GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	body, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxDecompressedSize {
+		return nil, fmt.Errorf("body is larger than %d bytes", maxDecompressedSize)
+	}
+	return body, nil
+}
+
+// zstdCompressor shares one encoder and decoder between goroutines.
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	if err != nil {
+		panic(err)
+	}
+	return &zstdCompressor{enc: enc, dec: dec}
+}
+
+func (*zstdCompressor) Encoding() string {
+	return EncodingZstd
+}
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	return c.dec.DecodeAll(data, nil)
+}
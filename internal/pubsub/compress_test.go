@@ -0,0 +1,81 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	long := note{Text: strings.Repeat("attack at dawn ", 200)}
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			msg := sent(t, long, WithCompression(encoding, DefaultCompressionThreshold))
+			if msg.ContentEncoding != encoding {
+				t.Errorf("ContentEncoding = %q, want %q", msg.ContentEncoding, encoding)
+			}
+			if len(msg.Body) >= len(long.Text)/10 {
+				t.Errorf("body of %d bytes wasn't compressed", len(msg.Body))
+			}
+			body, err := Decompress(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(body, []byte(long.Text)) {
+				t.Errorf("decompressed %q", body)
+			}
+			// decoding decompresses the body itself
+			got, err := Decode[note](msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != long {
+				t.Errorf("decoded %d characters, want %d", len(got.Text), len(long.Text))
+			}
+		})
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		msg := sent(t, note{Text: "short"}, WithCompression(encoding, DefaultCompressionThreshold))
+		if msg.ContentEncoding != "" {
+			t.Errorf("%s: ContentEncoding of a short body = %q", encoding, msg.ContentEncoding)
+		}
+		if !bytes.Contains(msg.Body, []byte("short")) {
+			t.Errorf("%s: short body %q was changed", encoding, msg.Body)
+		}
+	}
+}
+
+func TestSubscriptionDecompresses(t *testing.T) {
+	conn := NewMemoryBroker().Connect()
+	handled := make(chan note, 2)
+	sub, err := SubscribeHandler(context.Background(), conn, "amq.direct", "notes", "note", Durable,
+		func(_ context.Context, n note, _ Metadata) (AckType, error) {
+			handled <- n
+			return Ack, nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ch := memChannelOf(t, conn.broker)
+	long := note{Text: strings.Repeat("attack at dawn ", 200)}
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		if err := Publish(ch, "amq.direct", "note", ContentTypeJSON, long, WithCompression(encoding, 0)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-handled:
+			if got != long {
+				t.Errorf("%s: handled %d characters, want %d", encoding, len(got.Text), len(long.Text))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: the message wasn't handled", encoding)
+		}
+	}
+}
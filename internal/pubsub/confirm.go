@@ -0,0 +1,310 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrUnroutable     = errors.New("no queue received the message")
+	ErrNacked         = errors.New("broker nacked the message")
+	ErrConfirmTimeout = errors.New("timed out waiting for the broker to confirm the message")
+	ErrConfirmLost    = errors.New("channel closed before the broker confirmed the message")
+)
+
+// confirmer is implemented by channels that support publisher confirms.
+type confirmer interface {
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+}
+
+// returner is implemented by channels that return unroutable mandatory
+// messages.
+type returner interface {
+	NotifyReturn(returns chan amqp.Return) chan amqp.Return
+}
+
+var (
+	_ confirmer = (*amqp.Channel)(nil)
+	_ confirmer = (*memChannel)(nil)
+	_ returner  = (*amqp.Channel)(nil)
+	_ returner  = (*memChannel)(nil)
+)
+
+// ReturnedError is the error for a mandatory message the broker returned
+// because no queue received it. It matches ErrUnroutable with errors.Is.
+type ReturnedError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *ReturnedError) Error() string {
+	return fmt.Sprintf("message to exchange %q with key %q was returned: %s", e.Exchange, e.RoutingKey, e.ReplyText)
+}
+
+func (e *ReturnedError) Unwrap() error {
+	return ErrUnroutable
+}
+
+// ConfirmingPublisher publishes on a channel in confirm mode so callers learn
+// whether the broker actually took responsibility for each message.
+// PublishWithContext waits for the confirm, while PublishDeferred returns a
+// PendingConfirm to track it asynchronously. It is safe for concurrent use.
+type ConfirmingPublisher struct {
+	broker  Broker
+	timeout time.Duration
+
+	mu  sync.Mutex
+	cur *confirmChannel
+}
+
+// NewConfirmingPublisher opens confirm-mode channels on broker as needed.
+// PublishWithContext fails with ErrConfirmTimeout when no confirm arrives
+// within timeout.
+func NewConfirmingPublisher(broker Broker, timeout time.Duration) *ConfirmingPublisher {
+	return &ConfirmingPublisher{broker: broker, timeout: timeout}
+}
+
+// PendingConfirm is the outcome of a publish awaiting its broker confirm.
+type PendingConfirm struct {
+	done chan struct{}
+	err  error
+	// returnID is the message ID of a mandatory publish, to match the
+	// message if it is returned.
+	returnID string
+}
+
+func (c *PendingConfirm) resolve(err error) {
+	c.err = err
+	close(c.done)
+}
+
+// Done is closed once the broker has acked or nacked the message, or the
+// channel was closed first.
+func (c *PendingConfirm) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err reports the outcome once Done is closed: nil for an ack, ErrNacked for
+// a nack, a *ReturnedError for a mandatory message no queue received and
+// ErrConfirmLost if the channel closed first.
+func (c *PendingConfirm) Err() error {
+	<-c.done
+	return c.err
+}
+
+func (c *PendingConfirm) Wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *ConfirmingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	confirm, err := p.PublishDeferred(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case <-confirm.Done():
+		return confirm.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return ErrConfirmTimeout
+	}
+}
+
+func (p *ConfirmingPublisher) PublishDeferred(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*PendingConfirm, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cc, err := p.channelLocked()
+	if err != nil {
+		return nil, err
+	}
+	// Returns are matched to publishes by message ID.
+	returnID := ""
+	if mandatory {
+		if msg.MessageId == "" {
+			msg.MessageId = NewMessageID()
+		}
+		returnID = msg.MessageId
+	}
+	confirm, seq, err := cc.track(returnID)
+	if err != nil {
+		p.cur = nil
+		return nil, err
+	}
+	if err := cc.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg); err != nil {
+		cc.untrack(seq)
+		cc.ch.Close()
+		p.cur = nil
+		return nil, err
+	}
+	return confirm, nil
+}
+
+func (p *ConfirmingPublisher) channelLocked() (*confirmChannel, error) {
+	if p.cur != nil && !p.cur.isClosed() {
+		return p.cur, nil
+	}
+	ch, err := p.broker.Channel()
+	if err != nil {
+		return nil, err
+	}
+	c, ok := ch.(confirmer)
+	if !ok {
+		ch.Close()
+		return nil, errors.New("channel does not support publisher confirms")
+	}
+	if err := c.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	p.cur = &confirmChannel{ch: ch, pending: map[uint64]*PendingConfirm{}, returned: map[string]amqp.Return{}}
+	var returns chan amqp.Return
+	if r, ok := ch.(returner); ok {
+		returns = r.NotifyReturn(make(chan amqp.Return, 64))
+	}
+	go p.cur.listen(c.NotifyPublish(make(chan amqp.Confirmation, 64)), returns)
+	return p.cur, nil
+}
+
+func (p *ConfirmingPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cur == nil {
+		return nil
+	}
+	err := p.cur.ch.Close()
+	p.cur = nil
+	return err
+}
+
+// confirmChannel matches confirms on one channel to their publishes by
+// sequence number.
+type confirmChannel struct {
+	ch Channel
+
+	mu       sync.Mutex
+	seq      uint64
+	pending  map[uint64]*PendingConfirm
+	returned map[string]amqp.Return
+	closed   bool
+}
+
+func (cc *confirmChannel) track(returnID string) (*PendingConfirm, uint64, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.closed {
+		return nil, 0, ErrConfirmLost
+	}
+	cc.seq++
+	confirm := &PendingConfirm{done: make(chan struct{}), returnID: returnID}
+	cc.pending[cc.seq] = confirm
+	return confirm, cc.seq, nil
+}
+
+func (cc *confirmChannel) untrack(seq uint64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	delete(cc.pending, seq)
+}
+
+func (cc *confirmChannel) isClosed() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.closed
+}
+
+// listen resolves pending publishes as their confirms arrive. The broker
+// sends a mandatory message's return before its confirm, so returns already
+// received are taken in before each confirm is matched.
+func (cc *confirmChannel) listen(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			cc.recordReturn(r)
+		case c, ok := <-confirms:
+			if !ok {
+				cc.closePending()
+				return
+			}
+			for drained := false; !drained && returns != nil; {
+				select {
+				case r, ok := <-returns:
+					if !ok {
+						returns = nil
+						break
+					}
+					cc.recordReturn(r)
+				default:
+					drained = true
+				}
+			}
+			cc.resolve(c)
+		}
+	}
+}
+
+func (cc *confirmChannel) recordReturn(r amqp.Return) {
+	if r.MessageId == "" {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.returned[r.MessageId] = r
+}
+
+func (cc *confirmChannel) resolve(c amqp.Confirmation) {
+	cc.mu.Lock()
+	confirm, ok := cc.pending[c.DeliveryTag]
+	delete(cc.pending, c.DeliveryTag)
+	r, returned := amqp.Return{}, false
+	if ok && confirm.returnID != "" {
+		r, returned = cc.returned[confirm.returnID]
+		delete(cc.returned, confirm.returnID)
+	}
+	cc.mu.Unlock()
+	switch {
+	case !ok:
+	case !c.Ack:
+		confirm.resolve(ErrNacked)
+	case returned:
+		confirm.resolve(&ReturnedError{
+			Exchange:   r.Exchange,
+			RoutingKey: r.RoutingKey,
+			ReplyCode:  r.ReplyCode,
+			ReplyText:  r.ReplyText,
+		})
+	default:
+		confirm.resolve(nil)
+	}
+}
+
+func (cc *confirmChannel) closePending() {
+	cc.mu.Lock()
+	cc.closed = true
+	pending := cc.pending
+	cc.pending = nil
+	cc.mu.Unlock()
+	for _, confirm := range pending {
+		confirm.resolve(ErrConfirmLost)
+	}
+}
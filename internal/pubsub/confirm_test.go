@@ -0,0 +1,190 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// heldConfirms is a connection whose channels never confirm a publish, as
+// if the broker were stalled.
+type heldConfirms struct {
+	*MemoryConnection
+}
+
+func (c heldConfirms) Channel() (Channel, error) {
+	ch, err := c.MemoryConnection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return heldChannel{ch.(*memChannel)}, nil
+}
+
+type heldChannel struct {
+	*memChannel
+}
+
+func (ch heldChannel) NotifyPublish(receiver chan amqp.Confirmation) chan amqp.Confirmation {
+	confirms := ch.memChannel.NotifyPublish(make(chan amqp.Confirmation, 64))
+	go func() {
+		for range confirms {
+		}
+		close(receiver)
+	}()
+	return receiver
+}
+
+func TestConfirmingPublisherOutcomes(t *testing.T) {
+	mb := NewMemoryBroker()
+	ch := memChannelOf(t, mb)
+	for name, args := range map[string]amqp.Table{
+		"open": nil,
+		"full": {"x-max-length": int64(1), "x-overflow": OverflowRejectPublish},
+	} {
+		if _, err := ch.QueueDeclare(name, true, false, false, false, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publishTo(t, ch, "", "full", "first")
+
+	pub := NewConfirmingPublisher(mb.Connect(), time.Second)
+	defer pub.Close()
+	publishes := []struct {
+		key       string
+		mandatory bool
+		want      error
+	}{
+		{"open", false, nil},
+		{"nowhere", true, ErrUnroutable},
+		{"full", false, ErrNacked},
+		{"open", true, nil},
+		{"nowhere", false, nil},
+		{"full", true, ErrNacked},
+		{"nowhere", true, ErrUnroutable},
+	}
+	// published together, so each outcome must be matched to its message
+	pending := make([]*PendingConfirm, len(publishes))
+	for i, p := range publishes {
+		confirm, err := pub.PublishDeferred(context.Background(), "", p.key, p.mandatory, false, amqp.Publishing{Body: []byte(p.key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending[i] = confirm
+	}
+	for i, p := range publishes {
+		err := pending[i].Err()
+		if !errors.Is(err, p.want) {
+			t.Errorf("publish %d to %s (mandatory %v) = %v, want %v", i, p.key, p.mandatory, err, p.want)
+		}
+		var returned *ReturnedError
+		if errors.As(err, &returned) && returned.RoutingKey != p.key {
+			t.Errorf("publish %d to %s was returned as %s", i, p.key, returned.RoutingKey)
+		}
+	}
+	if got := mustGet(t, ch, "full"); string(got.Body) != "first" {
+		t.Errorf("full holds %q, want the message it had", got.Body)
+	}
+}
+
+func TestConfirmingPublisherReopensAfterFailure(t *testing.T) {
+	pub := NewConfirmingPublisher(NewMemoryBroker().Connect(), time.Second)
+	defer pub.Close()
+	// publishing to a missing exchange closes the channel
+	if err := pub.PublishWithContext(context.Background(), "missing", "key", false, false, amqp.Publishing{}); err == nil {
+		t.Fatal("published to a missing exchange")
+	}
+	if err := pub.PublishWithContext(context.Background(), "amq.direct", "key", false, false, amqp.Publishing{}); err != nil {
+		t.Errorf("publishing after a failure = %v", err)
+	}
+}
+
+func TestConfirmingPublisherTimeout(t *testing.T) {
+	pub := NewConfirmingPublisher(heldConfirms{NewMemoryBroker().Connect()}, 20*time.Millisecond)
+	defer pub.Close()
+	err := pub.PublishWithContext(context.Background(), "amq.direct", "key", false, false, amqp.Publishing{})
+	if err != ErrConfirmTimeout {
+		t.Errorf("err = %v, want ErrConfirmTimeout", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	pending, err := pub.PublishDeferred(ctx, "amq.direct", "key", false, false, amqp.Publishing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pending.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestConfirmingPublisherConfirmLost(t *testing.T) {
+	mb := NewMemoryBroker()
+	pub := NewConfirmingPublisher(heldConfirms{mb.Connect()}, time.Second)
+	defer pub.Close()
+	var pending []*PendingConfirm
+	for range 3 {
+		confirm, err := pub.PublishDeferred(context.Background(), "amq.direct", "key", false, false, amqp.Publishing{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, confirm)
+	}
+	mb.Restart()
+	for i, confirm := range pending {
+		select {
+		case <-confirm.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("publish %d is still pending after its channel closed", i)
+		}
+		if err := confirm.Err(); err != ErrConfirmLost {
+			t.Errorf("publish %d = %v, want ErrConfirmLost", i, err)
+		}
+	}
+}
+
+func TestMandatoryPublish(t *testing.T) {
+	events := Topology{Exchanges: []ExchangeSpec{{Name: "events", Kind: amqp.ExchangeTopic, Durable: true}}}
+	tests := []struct {
+		name     string
+		topology Topology
+		returned bool
+	}{
+		{"no alternate exchange", events, true},
+		{"alternate exchange", events.WithAlternateExchange("events.unroutable", "unroutable", "events"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewMemoryBroker().Connect()
+			if err := tt.topology.Declare(conn); err != nil {
+				t.Fatal(err)
+			}
+			pub := NewConfirmingPublisher(conn, time.Second)
+			defer pub.Close()
+			err := Publish(pub, "events", "nobody.listens", ContentTypeJSON, note{Text: "hello"}, Mandatory())
+
+			var returned *ReturnedError
+			if !tt.returned {
+				if err != nil {
+					t.Fatalf("Publish = %v, want the alternate exchange to take it", err)
+				}
+				msg := mustGet(t, memChannelOf(t, conn.broker), "unroutable")
+				if msg.Exchange != "events" || msg.RoutingKey != "nobody.listens" {
+					t.Errorf("unroutable received a message to %s with key %s", msg.Exchange, msg.RoutingKey)
+				}
+				return
+			}
+			if !errors.As(err, &returned) {
+				t.Fatalf("Publish = %v, want a *ReturnedError", err)
+			}
+			if returned.Exchange != "events" || returned.RoutingKey != "nobody.listens" || returned.ReplyCode != amqp.NoRoute {
+				t.Errorf("returned %+v", returned)
+			}
+			if !errors.Is(err, ErrUnroutable) {
+				t.Error("a *ReturnedError doesn't match ErrUnroutable")
+			}
+		})
+	}
+}
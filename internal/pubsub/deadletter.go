@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeadLetterExchange receives messages rejected from queues declared by
+// DeclareAndBind.
+const DeadLetterExchange = "peril_dlx"
+
+// Headers set on messages this package dead-letters itself, alongside the
+// x-death headers the broker adds when it dead-letters a message.
+const (
+	HeaderDeadLetterReason   = "x-peril-dead-letter-reason"
+	HeaderOriginalExchange   = "x-peril-original-exchange"
+	HeaderOriginalRoutingKey = "x-peril-original-routing-key"
+	HeaderOriginalQueue      = "x-peril-original-queue"
+)
+
+func deadLetterPublishing(msg amqp.Delivery, queue string, class ErrorClass, reason string) amqp.Publishing {
+	pub := deliveryPublishing(msg)
+	pub.Headers[HeaderDeadLetterReason] = reason
+	pub.Headers[HeaderErrorClass] = string(class)
+	pub.Headers[HeaderOriginalExchange] = msg.Exchange
+	pub.Headers[HeaderOriginalRoutingKey] = msg.RoutingKey
+	pub.Headers[HeaderOriginalQueue] = queue
+	return pub
+}
+
+// deliveryPublishing copies msg for republishing, with headers that are safe
+// to modify.
+func deliveryPublishing(msg amqp.Delivery) amqp.Publishing {
+	headers := cloneTable(msg.Headers)
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+// OriginalRoute reports where a dead-lettered message was first published:
+// from the headers this package sets, falling back to the broker's most
+// recent x-death entry.
+func OriginalRoute(msg amqp.Delivery) (exchange, key string) {
+	exchange, ok := msg.Headers[HeaderOriginalExchange].(string)
+	key, _ = msg.Headers[HeaderOriginalRoutingKey].(string)
+	if ok {
+		return exchange, key
+	}
+	if deaths, _ := msg.Headers["x-death"].([]interface{}); len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			exchange, _ = death["exchange"].(string)
+			if keys, _ := death["routing-keys"].([]interface{}); len(keys) > 0 {
+				key, _ = keys[0].(string)
+			}
+			return exchange, key
+		}
+	}
+	return msg.Exchange, msg.RoutingKey
+}
+
+// RequeuePublishing copies a dead-lettered message for publishing back to
+// its original route, without the dead-letter and retry headers.
+func RequeuePublishing(msg amqp.Delivery) amqp.Publishing {
+	pub := deliveryPublishing(msg)
+	for _, h := range []string{
+		"x-death",
+		"x-first-death-reason",
+		"x-first-death-queue",
+		"x-first-death-exchange",
+		"x-last-death-reason",
+		"x-last-death-queue",
+		"x-last-death-exchange",
+		HeaderDeadLetterReason,
+		HeaderErrorClass,
+		HeaderOriginalExchange,
+		HeaderOriginalRoutingKey,
+		HeaderOriginalQueue,
+		HeaderAttempt,
+		HeaderSkips,
+	} {
+		delete(pub.Headers, h)
+	}
+	return pub
+}
@@ -0,0 +1,218 @@
+package pubsub
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupStore remembers the message IDs a subscription has handled so
+// redeliveries of them can be skipped.
+type DedupStore interface {
+	Seen(id string) (bool, error)
+	Mark(id string) error
+}
+
+// WithDedup acks deliveries whose message ID is already in store without
+// handling them, and records each message the handler acks. Messages
+// without an ID are always handled. IDs are recorded per queue, so one
+// store can serve several subscriptions.
+func WithDedup(store DedupStore) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.dedup = store
+	}
+}
+
+// MemoryDedupStore keeps up to capacity IDs for ttl each, forgetting the
+// least recently seen first.
+type MemoryDedupStore struct {
+	capacity int
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+type dedupEntry struct {
+	id      string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		ids:      map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupStore) Seen(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.ids[id]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(e.Value.(*dedupEntry).expires) {
+		s.order.Remove(e)
+		delete(s.ids, id)
+		return false, nil
+	}
+	s.order.MoveToFront(e)
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Mark(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.markLocked(id, time.Now().Add(s.ttl))
+	return nil
+}
+
+func (s *MemoryDedupStore) markLocked(id string, expires time.Time) {
+	if e, ok := s.ids[id]; ok {
+		e.Value.(*dedupEntry).expires = expires
+		s.order.MoveToFront(e)
+		return
+	}
+	s.ids[id] = s.order.PushFront(&dedupEntry{id: id, expires: expires})
+	for s.capacity > 0 && s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(*dedupEntry).id)
+	}
+}
+
+// FileDedupStore is a MemoryDedupStore whose IDs are appended to a file,
+// so they survive restarts. Expired and forgotten IDs are dropped from the
+// file when it is opened, and whenever it grows to twice the IDs remembered
+// and at least minCompactLines.
+type FileDedupStore struct {
+	*MemoryDedupStore
+	path string
+
+	fileMu sync.Mutex
+	file   *os.File
+	lines  int
+}
+
+const minCompactLines = 1024
+
+// OpenFileDedupStore loads the unexpired IDs recorded in path, creating it
+// if needed.
+func OpenFileDedupStore(path string, capacity int, ttl time.Duration) (*FileDedupStore, error) {
+	mem := NewMemoryDedupStore(capacity, ttl)
+	if err := mem.load(path); err != nil {
+		return nil, err
+	}
+	s := &FileDedupStore{MemoryDedupStore: mem, path: path}
+	if err := s.compactLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compactLocked rewrites the file with only the IDs still remembered.
+func (s *FileDedupStore) compactLocked() error {
+	s.mu.Lock()
+	entries := make([]dedupEntry, 0, s.order.Len())
+	for e := s.order.Back(); e != nil; e = e.Prev() {
+		entries = append(entries, *e.Value.(*dedupEntry))
+	}
+	s.mu.Unlock()
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	now := time.Now()
+	lines := 0
+	for _, entry := range entries {
+		if entry.expires.After(now) {
+			fmt.Fprintf(w, "%d %s\n", entry.expires.UnixNano(), entry.id)
+			lines++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	f, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, s.lines = f, lines
+	return nil
+}
+
+func (s *MemoryDedupStore) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		expiry, id, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		nanos, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil {
+			continue
+		}
+		if expires := time.Unix(0, nanos); expires.After(now) {
+			s.markLocked(id, expires)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *FileDedupStore) Mark(id string) error {
+	expires := time.Now().Add(s.ttl)
+	s.mu.Lock()
+	s.markLocked(id, expires)
+	remembered := s.order.Len()
+	s.mu.Unlock()
+
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if _, err := fmt.Fprintf(s.file, "%d %s\n", expires.UnixNano(), id); err != nil {
+		return err
+	}
+	s.lines++
+	if s.lines < max(minCompactLines, 2*remembered) {
+		return nil
+	}
+	return s.compactLocked()
+}
+
+func (s *FileDedupStore) Close() error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	return s.file.Close()
+}
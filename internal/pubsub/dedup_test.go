@@ -0,0 +1,130 @@
+package pubsub
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func seen(t *testing.T, store DedupStore, id string) bool {
+	t.Helper()
+	ok, err := store.Seen(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func mark(t *testing.T, store DedupStore, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := store.Mark(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemoryDedupStoreEvictsLeastRecentlySeen(t *testing.T) {
+	store := NewMemoryDedupStore(2, time.Hour)
+	mark(t, store, "a", "b")
+	// seeing a makes b the least recently seen
+	if !seen(t, store, "a") {
+		t.Fatal("a was forgotten")
+	}
+	mark(t, store, "c")
+	for id, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if got := seen(t, store, id); got != want {
+			t.Errorf("Seen(%s) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestMemoryDedupStoreExpiry(t *testing.T) {
+	store := NewMemoryDedupStore(10, 20*time.Millisecond)
+	mark(t, store, "a")
+	if !seen(t, store, "a") {
+		t.Fatal("a was forgotten straight away")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if seen(t, store, "a") {
+		t.Error("a was remembered after its TTL")
+	}
+	// marking again remembers it anew
+	mark(t, store, "a")
+	if !seen(t, store, "a") {
+		t.Error("a wasn't remembered after being marked again")
+	}
+}
+
+func TestFileDedupStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handled.dedup")
+	store, err := OpenFileDedupStore(path, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mark(t, store, "a", "b")
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// an ID that expired while the store was closed is dropped on reload
+	expired := fmt.Sprintf("%d stale\n", time.Now().Add(-time.Minute).UnixNano())
+	if err := appendFile(path, expired+"garbage\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileDedupStore(path, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for id, want := range map[string]bool{"a": true, "b": true, "stale": false, "c": false} {
+		if got := seen(t, store, id); got != want {
+			t.Errorf("Seen(%s) = %v, want %v", id, got, want)
+		}
+	}
+	if data, _ := os.ReadFile(path); bytes.Contains(data, []byte("stale")) || bytes.Contains(data, []byte("garbage")) {
+		t.Errorf("reopening left %q in the file", data)
+	}
+}
+
+func TestFileDedupStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handled.dedup")
+	store, err := OpenFileDedupStore(path, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for i := range 3 * minCompactLines {
+		mark(t, store, fmt.Sprint(i))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines >= minCompactLines {
+		t.Errorf("the file has %d lines for 10 IDs", lines)
+	}
+	reloaded, err := OpenFileDedupStore(path, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	last := fmt.Sprint(3*minCompactLines - 1)
+	if !seen(t, reloaded, last) || seen(t, reloaded, "0") {
+		t.Error("compaction kept the wrong IDs")
+	}
+}
+
+func appendFile(path, data string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(data)
+	return err
+}
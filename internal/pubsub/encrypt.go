@@ -0,0 +1,180 @@
+package pubsub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderKeyID names the key an encrypted message's body was sealed with.
+// Messages without it are not encrypted.
+const HeaderKeyID = "x-peril-key-id"
+
+var (
+	ErrNoKeyProvider = errors.New("message is encrypted but no key provider is set")
+	ErrNotEncrypted  = errors.New("message is not encrypted")
+)
+
+// KeyProvider looks up encryption keys by ID. Keys are 16, 24 or 32 bytes,
+// selecting AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	EncryptionKey(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider holding a fixed set of keys.
+type StaticKeys map[string][]byte
+
+func (k StaticKeys) EncryptionKey(id string) ([]byte, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// DerivedKeys is a KeyProvider deriving a 256-bit key for every ID from one
+// secret, so a receiver can hand each sender a key of its own without
+// keeping track of them.
+type DerivedKeys []byte
+
+func (k DerivedKeys) EncryptionKey(id string) ([]byte, error) {
+	if len(k) == 0 {
+		return nil, errors.New("no secret to derive keys from")
+	}
+	mac := hmac.New(sha256.New, k)
+	mac.Write(appendFields([]byte("peril key\x00"), id))
+	return mac.Sum(nil), nil
+}
+
+// OpenSecret reads the secret kept in path, generating 32 random bytes the
+// first time.
+func OpenSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, secret, 0600); err != nil {
+			return nil, err
+		}
+		return secret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("%s holds %d bytes, not a 32-byte secret", path, len(secret))
+	}
+	return secret, nil
+}
+
+// WithEncryption seals the body with AES-GCM under the key keys holds for
+// keyID, after any compression. Only subscribers with the key can read it;
+// headers and properties stay in the clear.
+func WithEncryption(keyID string, keys KeyProvider) PublishOption {
+	return func(p *publishing) {
+		p.encryptKeyID = keyID
+		p.encryptKeys = keys
+	}
+}
+
+// encrypt applies the encryption p asked for. It must run after the body is
+// otherwise final and before it is signed.
+func (p *publishing) encrypt() error {
+	if p.encryptKeys == nil {
+		return nil
+	}
+	aead, err := newAEAD(p.encryptKeys, p.encryptKeyID)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	p.Headers[HeaderKeyID] = p.encryptKeyID
+	p.Body = aead.Seal(nonce, nonce, p.Body, additionalData(p.encryptKeyID, p.Publishing))
+	return nil
+}
+
+// IsEncrypted reports whether msg's body was sealed WithEncryption.
+func IsEncrypted(msg amqp.Delivery) bool {
+	_, ok := msg.Headers[HeaderKeyID].(string)
+	return ok
+}
+
+// Decrypt returns the body of msg as it was before encryption, which may
+// still be compressed. Bodies that have been tampered with, or moved to
+// another message, are rejected.
+func Decrypt(msg amqp.Delivery, keys KeyProvider) ([]byte, error) {
+	if !IsEncrypted(msg) {
+		return msg.Body, nil
+	}
+	keyID := msg.Headers[HeaderKeyID].(string)
+	if keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+	aead, err := newAEAD(keys, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Body) < aead.NonceSize() {
+		return nil, errors.New("encrypted body is too short")
+	}
+	nonce, sealed := msg.Body[:aead.NonceSize()], msg.Body[aead.NonceSize():]
+	body, err := aead.Open(nil, nonce, sealed, additionalData(keyID, deliveryPublishing(msg)))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt with key %q: %w", keyID, err)
+	}
+	return body, nil
+}
+
+// WithDecryption decrypts encrypted deliveries with keys before decoding
+// them. Without it, encrypted deliveries are dead-lettered.
+func WithDecryption(keys KeyProvider) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decryptKeys = keys
+	}
+}
+
+// WithRequiredEncryption dead-letters deliveries that aren't encrypted, for
+// subscribers whose messages must not be readable on the way.
+func WithRequiredEncryption() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.encrypted = true
+	}
+}
+
+func newAEAD(keys KeyProvider, keyID string) (cipher.AEAD, error) {
+	key, err := keys.EncryptionKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", keyID, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds the ciphertext to the message it was sent in, so it
+// can't be replayed under another identity or decoded as something else.
+func additionalData(keyID string, msg amqp.Publishing) []byte {
+	return appendFields(nil,
+		keyID,
+		msg.MessageId,
+		strconv.FormatInt(msg.Timestamp.Unix(), 10),
+		msg.Type,
+		msg.ContentType,
+		msg.ContentEncoding,
+	)
+}
@@ -0,0 +1,261 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/pubsubtest"
+)
+
+type note struct {
+	Text string
+}
+
+var testKeys = StaticKeys{
+	"k1": bytes.Repeat([]byte{1}, 32),
+	"k2": bytes.Repeat([]byte{2}, 16),
+}
+
+// sent publishes value to the queue "notes" on a new memory broker and
+// returns it as delivered.
+func sent(t *testing.T, value any, opts ...PublishOption) amqp.Delivery {
+	t.Helper()
+	conn := NewMemoryBroker().Connect()
+	err := Topology{
+		Queues:   []QueueSpec{{Name: "notes"}},
+		Bindings: []BindingSpec{{Queue: "notes", Exchange: "amq.direct", Key: "note"}},
+	}.Declare(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if err := Publish(ch, "amq.direct", "note", ContentTypeJSON, value, opts...); err != nil {
+		t.Fatal(err)
+	}
+	msg, ok, err := ch.Get("notes", true)
+	if err != nil || !ok {
+		t.Fatalf("Get = %v, %v", ok, err)
+	}
+	return msg
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	want := note{Text: strings.Repeat("attack at dawn ", 100)}
+	tests := []struct {
+		name     string
+		keyID    string
+		opts     []PublishOption
+		encoding string
+	}{
+		{"AES-256", "k1", nil, ""},
+		{"AES-128", "k2", nil, ""},
+		{"compressed", "k1", []PublishOption{WithCompression(EncodingZstd, 0)}, EncodingZstd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := sent(t, want, append(tt.opts, WithEncryption(tt.keyID, testKeys))...)
+			if msg.Headers[HeaderKeyID] != tt.keyID || msg.ContentEncoding != tt.encoding {
+				t.Errorf("sent with key %v and encoding %q", msg.Headers[HeaderKeyID], msg.ContentEncoding)
+			}
+			if bytes.Contains(msg.Body, []byte("attack")) {
+				t.Error("the body was sent in the clear")
+			}
+
+			body, err := Decrypt(msg, testKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg.Body = body
+			got, err := Decode[note](msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("decrypted %.20q..., want %.20q...", got.Text, want.Text)
+			}
+		})
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(*amqp.Delivery)
+	}{
+		{"body", func(m *amqp.Delivery) { m.Body[len(m.Body)-1] ^= 1 }},
+		{"truncated body", func(m *amqp.Delivery) { m.Body = m.Body[:8] }},
+		{"key ID", func(m *amqp.Delivery) { m.Headers[HeaderKeyID] = "k2" }},
+		{"unknown key ID", func(m *amqp.Delivery) { m.Headers[HeaderKeyID] = "k3" }},
+		{"message ID", func(m *amqp.Delivery) { m.MessageId = "another" }},
+		{"content encoding", func(m *amqp.Delivery) { m.ContentEncoding = EncodingGzip }},
+		{"content type", func(m *amqp.Delivery) { m.ContentType = ContentTypeGob }},
+		{"type", func(m *amqp.Delivery) { m.Type = "pubsub.other" }},
+		{"timestamp", func(m *amqp.Delivery) { m.Timestamp = m.Timestamp.Add(time.Second) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := sent(t, note{Text: "attack at dawn"}, WithEncryption("k1", testKeys))
+			if _, err := Decrypt(msg, testKeys); err != nil {
+				t.Fatalf("untouched message: %v", err)
+			}
+			tt.tamper(&msg)
+			if body, err := Decrypt(msg, testKeys); err == nil {
+				t.Errorf("decrypted tampered message as %q", body)
+			}
+		})
+	}
+}
+
+func TestDecryptWithoutKeys(t *testing.T) {
+	msg := sent(t, note{Text: "attack at dawn"}, WithEncryption("k1", testKeys))
+	if _, err := Decrypt(msg, nil); !errors.Is(err, ErrNoKeyProvider) {
+		t.Errorf("err = %v, want ErrNoKeyProvider", err)
+	}
+
+	plain := sent(t, note{Text: "attack at dawn"})
+	body, err := Decrypt(plain, testKeys)
+	if err != nil || !bytes.Equal(body, plain.Body) {
+		t.Errorf("unencrypted body decrypted as %q, %v", body, err)
+	}
+}
+
+func TestEncryptionRejectsBadKeys(t *testing.T) {
+	ch, err := NewMemoryBroker().Connect().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := StaticKeys{"short": make([]byte, 10)}
+	for _, keyID := range []string{"short", "missing"} {
+		if err := Publish(ch, "amq.direct", "note", ContentTypeJSON, note{}, WithEncryption(keyID, keys)); err == nil {
+			t.Errorf("published with key %q", keyID)
+		}
+	}
+}
+
+func TestDerivedKeys(t *testing.T) {
+	keys := DerivedKeys("a secret of at least thirty-two bytes")
+	alice, err := keys.EncryptionKey("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alice) != 32 {
+		t.Errorf("derived a %d-byte key", len(alice))
+	}
+	if again, _ := keys.EncryptionKey("alice"); !bytes.Equal(again, alice) {
+		t.Error("derived a different key for the same ID")
+	}
+	if bob, _ := keys.EncryptionKey("bob"); bytes.Equal(bob, alice) {
+		t.Error("derived the same key for two IDs")
+	}
+	if other, _ := DerivedKeys("another secret of thirty-two bytes").EncryptionKey("alice"); bytes.Equal(other, alice) {
+		t.Error("derived the same key from two secrets")
+	}
+	if _, err := DerivedKeys(nil).EncryptionKey("alice"); err == nil {
+		t.Error("derived a key without a secret")
+	}
+}
+
+func TestOpenSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	secret, err := OpenSecret(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("generated a %d-byte secret", len(secret))
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("secret file: %v, %v", info, err)
+	}
+	if again, err := OpenSecret(path); err != nil || !bytes.Equal(again, secret) {
+		t.Errorf("reopened secret %x, %v; want %x", again, err, secret)
+	}
+
+	if err := os.WriteFile(path, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSecret(path); err == nil {
+		t.Error("opened a short secret")
+	}
+}
+
+func TestSubscriptionDecrypts(t *testing.T) {
+	tests := []struct {
+		name    string
+		publish []PublishOption
+		opts    []SubscribeOption
+		handled bool
+	}{
+		{"encrypted", []PublishOption{WithEncryption("k1", testKeys)}, []SubscribeOption{WithDecryption(testKeys)}, true},
+		{"no keys", []PublishOption{WithEncryption("k1", testKeys)}, nil, false},
+		{"unencrypted", nil, []SubscribeOption{WithDecryption(testKeys)}, true},
+		{"unencrypted but required", nil, []SubscribeOption{WithDecryption(testKeys), WithRequiredEncryption()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewMemoryBroker().Connect()
+			if err := DeadLetterTopology("dead").Declare(conn); err != nil {
+				t.Fatal(err)
+			}
+			handled := make(chan note, 1)
+			sub, err := SubscribeHandler(context.Background(), conn, "amq.direct", "notes", "note", Durable,
+				func(_ context.Context, n note, _ Metadata) (AckType, error) {
+					handled <- n
+					return Ack, nil
+				},
+				tt.opts...,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			ch, err := conn.Channel()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ch.Close()
+			want := note{Text: "attack at dawn"}
+			if err := Publish(ch, "amq.direct", "note", ContentTypeJSON, want, tt.publish...); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.handled {
+				select {
+				case got := <-handled:
+					if got != want {
+						t.Errorf("handled %+v, want %+v", got, want)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("the message wasn't handled")
+				}
+				return
+			}
+			dead := pubsubtest.Poll(t, conn.Channel, "dead")
+			if dead.Headers[HeaderErrorClass] != string(ClassPermanent) {
+				t.Errorf("dead-lettered as %v", dead.Headers[HeaderErrorClass])
+			}
+			// dead letters stay encrypted
+			if bytes.Contains(dead.Body, []byte("attack")) != (len(tt.publish) == 0) {
+				t.Errorf("dead-lettered body %q", dead.Body)
+			}
+			select {
+			case n := <-handled:
+				t.Errorf("handled %+v", n)
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers that complete the envelope carried in the AMQP properties.
+const (
+	HeaderCausationID = "x-peril-causation-id"
+	HeaderSender      = "x-peril-sender"
+)
+
+// Metadata is the envelope of a message: its identity, where it came from
+// and how it was delivered. Publish fills in the identity, and subscriptions
+// started with SubscribeWithMetadata pass it to their handler.
+type Metadata struct {
+	MessageID string
+	// CorrelationID is shared by every message that follows from the same
+	// original message.
+	CorrelationID string
+	// CausationID is the MessageID of the message that led to this one.
+	CausationID string
+	Timestamp   time.Time
+	Type        string
+	Sender      string
+
+	ContentType string
+	ReplyTo     string
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	Headers     amqp.Table
+}
+
+// MetadataOf reads the envelope of a delivery.
+func MetadataOf(msg amqp.Delivery) Metadata {
+	causation, _ := msg.Headers[HeaderCausationID].(string)
+	sender, _ := msg.Headers[HeaderSender].(string)
+	return Metadata{
+		MessageID:     msg.MessageId,
+		CorrelationID: msg.CorrelationId,
+		CausationID:   causation,
+		Timestamp:     msg.Timestamp,
+		Type:          msg.Type,
+		Sender:        sender,
+		ContentType:   msg.ContentType,
+		ReplyTo:       msg.ReplyTo,
+		Exchange:      msg.Exchange,
+		RoutingKey:    msg.RoutingKey,
+		Redelivered:   msg.Redelivered,
+		Headers:       msg.Headers,
+	}
+}
+
+// PublishOption customises the envelope of a message sent with Publish.
+type PublishOption func(*publishing)
+
+// publishing is a message being prepared by Publish.
+type publishing struct {
+	amqp.Publishing
+	mandatory     bool
+	compression   string
+	compressAbove int
+	encryptKeyID  string
+	encryptKeys   KeyProvider
+	signKey       ed25519.PrivateKey
+}
+
+// WithMessageID replaces the generated message ID.
+func WithMessageID(id string) PublishOption {
+	return func(p *publishing) {
+		p.MessageId = id
+	}
+}
+
+// WithCorrelationID sets the correlation ID, which otherwise defaults to the
+// message ID.
+func WithCorrelationID(id string) PublishOption {
+	return func(p *publishing) {
+		p.CorrelationId = id
+	}
+}
+
+// CausedBy marks the message as following from the one described by cause,
+// continuing its correlation ID.
+func CausedBy(cause Metadata) PublishOption {
+	return func(p *publishing) {
+		p.CorrelationId = cause.CorrelationID
+		if p.CorrelationId == "" {
+			p.CorrelationId = cause.MessageID
+		}
+		if cause.MessageID != "" {
+			p.Headers[HeaderCausationID] = cause.MessageID
+		}
+	}
+}
+
+// WithSender records who sent the message.
+func WithSender(sender string) PublishOption {
+	return func(p *publishing) {
+		p.Headers[HeaderSender] = sender
+	}
+}
+
+// Mandatory asks the broker to return the message if no queue receives it.
+// Publishing through a ConfirmingPublisher then fails with a
+// *ReturnedError; other publishers drop returned messages.
+func Mandatory() PublishOption {
+	return func(p *publishing) {
+		p.mandatory = true
+	}
+}
+
+// envelope stamps a new message of value's type with a fresh ID and the
+// current time before applying opts.
+func envelope(value any, opts []PublishOption) publishing {
+	p := publishing{Publishing: amqp.Publishing{
+		Headers:   amqp.Table{},
+		MessageId: NewMessageID(),
+		Timestamp: time.Now().UTC(),
+		Type:      fmt.Sprintf("%T", value),
+	}}
+	for _, opt := range opts {
+		opt(&p)
+	}
+	if p.CorrelationId == "" {
+		p.CorrelationId = p.MessageId
+	}
+	return p
+}
+
+// NewMessageID returns a random version 4 UUID.
+func NewMessageID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"errors"
+)
+
+// HeaderErrorClass records the ErrorClass of the failure that got a message
+// dead-lettered, next to HeaderDeadLetterReason.
+const HeaderErrorClass = "x-peril-error-class"
+
+// ErrorClass tells a subscription what to do with a message whose handler
+// returned an error.
+type ErrorClass string
+
+const (
+	// ClassRetryable failures are retried like NackRequeue.
+	ClassRetryable ErrorClass = "retryable"
+	// ClassPermanent failures are dead-lettered straight away. Errors that
+	// aren't classified are permanent.
+	ClassPermanent ErrorClass = "permanent"
+	// ClassSkip hands the message back to its queue for another consumer
+	// without counting it as a failed attempt. With WithRetry it comes back
+	// after a delay, otherwise straight away.
+	ClassSkip ErrorClass = "skip"
+)
+
+type classifiedError struct {
+	class ErrorClass
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// Retryable, Permanent and Skip classify err. They return nil for a nil
+// err, so a handler can wrap whatever it got.
+func Retryable(err error) error {
+	return classify(ClassRetryable, err)
+}
+
+func Permanent(err error) error {
+	return classify(ClassPermanent, err)
+}
+
+func Skip(err error) error {
+	return classify(ClassSkip, err)
+}
+
+func classify(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// ClassOf reports the class of err, the outermost one if it was classified
+// more than once.
+func ClassOf(err error) ErrorClass {
+	var c *classifiedError
+	if errors.As(err, &c) {
+		return c.class
+	}
+	return ClassPermanent
+}
+
+// outcome is the AckType a handler's result amounts to.
+func outcome(acktype AckType, err error) AckType {
+	if err == nil {
+		return acktype
+	}
+	if ClassOf(err) == ClassPermanent {
+		return NackDiscard
+	}
+	return NackRequeue
+}
@@ -0,0 +1,70 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/pubsubtest"
+)
+
+func TestClassifyNil(t *testing.T) {
+	for name, classify := range map[string]func(error) error{
+		"Retryable": Retryable,
+		"Permanent": Permanent,
+		"Skip":      Skip,
+	} {
+		if err := classify(nil); err != nil {
+			t.Errorf("%s(nil) = %v, want nil", name, err)
+		}
+	}
+}
+
+func TestDeadLetterHeaders(t *testing.T) {
+	boom := errors.New("boom")
+	tests := []struct {
+		name   string
+		err    error
+		class  ErrorClass
+		reason string
+	}{
+		{"unclassified", boom, ClassPermanent, "boom"},
+		{"permanent", Permanent(boom), ClassPermanent, "boom"},
+		{"retryable", Retryable(boom), ClassRetryable, "gave up after 2 attempts: boom"},
+		{"skip", Skip(boom), ClassSkip, "skipped 1 times: boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewMemoryBroker().Connect()
+			if err := DeadLetterTopology("dead").Declare(conn); err != nil {
+				t.Fatal(err)
+			}
+			sub, err := SubscribeHandler(context.Background(), conn, "amq.direct", "notes", "note", Durable,
+				func(context.Context, note, Metadata) (AckType, error) {
+					return Ack, tt.err
+				},
+				WithRetry(RetryPolicy{MaxAttempts: 2, MaxSkips: 1, Backoff: Backoff{Min: time.Millisecond, Max: time.Millisecond}}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			if err := Publish(memChannelOf(t, conn.broker), "amq.direct", "note", ContentTypeJSON, note{Text: tt.name}); err != nil {
+				t.Fatal(err)
+			}
+
+			dead := pubsubtest.Poll(t, conn.Channel, "dead")
+			if dead.Headers[HeaderErrorClass] != string(tt.class) {
+				t.Errorf("%s = %v, want %s", HeaderErrorClass, dead.Headers[HeaderErrorClass], tt.class)
+			}
+			if reason, _ := dead.Headers[HeaderDeadLetterReason].(string); !strings.Contains(reason, tt.reason) {
+				t.Errorf("%s = %q, want %q", HeaderDeadLetterReason, reason, tt.reason)
+			}
+			if dead.Headers[HeaderOriginalQueue] != "notes" {
+				t.Errorf("%s = %v, want notes", HeaderOriginalQueue, dead.Headers[HeaderOriginalQueue])
+			}
+		})
+	}
+}
@@ -2,33 +2,13 @@ package pubsub
 
 import (
 	"bytes"
-	"context"
 	"encoding/gob"
-
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, value T) error {
-	buffer := new(bytes.Buffer)
-	if err := gob.NewEncoder(buffer).Encode(value); err != nil {
-		return err
-	}
+const ContentTypeGob = "application/gob"
 
-	if err := ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/gob",
-			Body:        buffer.Bytes(),
-		},
-	); err != nil {
-		return err
-	}
-
-	return nil
+func PublishGob[T any](pub Publisher, exchange, key string, value T, opts ...PublishOption) error {
+	return Publish(pub, exchange, key, ContentTypeGob, value, opts...)
 }
 
 func UnmarshalGob[T any](data []byte) (T, error) {
@@ -38,3 +18,21 @@ func UnmarshalGob[T any](data []byte) (T, error) {
 	}
 	return value, nil
 }
+
+type GobCodec struct{}
+
+func (GobCodec) ContentType() string {
+	return ContentTypeGob
+}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := gob.NewEncoder(buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -1,33 +1,13 @@
 package pubsub
 
 import (
-	"context"
 	"encoding/json"
-
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, value T) error {
-	data, err := json.Marshal(value)
-	if err != nil {
-		return err
-	}
-
-	if err := ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        data,
-		},
-	); err != nil {
-		return err
-	}
+const ContentTypeJSON = "application/json"
 
-	return nil
+func PublishJSON[T any](pub Publisher, exchange, key string, value T, opts ...PublishOption) error {
+	return Publish(pub, exchange, key, ContentTypeJSON, value, opts...)
 }
 
 func UnmarshalJSON[T any](data []byte) (T, error) {
@@ -37,3 +17,17 @@ func UnmarshalJSON[T any](data []byte) (T, error) {
 	}
 	return value, nil
 }
+
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
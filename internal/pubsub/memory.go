@@ -0,0 +1,1390 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process broker implementing the parts of AMQP 0-9-1
+// that Peril relies on: direct, fanout and topic exchanges, durable,
+// transient and exclusive queues, streams read from an offset, prefetch,
+// acks, nacks with requeue or dead-lettering, and queue length limits. Use
+// Connect to obtain a Broker for each simulated client.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	conns     map[*MemoryConnection]struct{}
+	names     uint64
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		conns:     map[*MemoryConnection]struct{}{},
+	}
+	for name, kind := range map[string]string{
+		"":           amqp.ExchangeDirect,
+		"amq.direct": amqp.ExchangeDirect,
+		"amq.fanout": amqp.ExchangeFanout,
+		"amq.topic":  amqp.ExchangeTopic,
+	} {
+		b.exchanges[name] = &memExchange{name: name, kind: kind, durable: true}
+	}
+	return b
+}
+
+// Connect opens a new connection to the broker. Exclusive queues declared
+// through it are deleted when it is closed.
+func (b *MemoryBroker) Connect() *MemoryConnection {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &MemoryConnection{broker: b, channels: map[*memChannel]struct{}{}}
+	b.conns[c] = struct{}{}
+	return c
+}
+
+// Restart simulates a broker restart. Every connection is closed with a
+// CONNECTION_FORCED error, and transient queues, transient exchanges and
+// non-persistent messages are lost.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.closeLocked(&amqp.Error{
+			Code:   amqp.ConnectionForced,
+			Reason: "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+			Server: true,
+		})
+	}
+	for _, q := range b.queues {
+		if !q.durable {
+			b.deleteQueueLocked(q)
+			continue
+		}
+		ready := q.ready[:0]
+		for _, m := range q.ready {
+			if m.pub.DeliveryMode == amqp.Persistent {
+				ready = append(ready, m)
+			}
+		}
+		q.ready = ready
+	}
+	for name, e := range b.exchanges {
+		if !e.durable {
+			delete(b.exchanges, name)
+		}
+	}
+}
+
+func (b *MemoryBroker) nextName(prefix string) string {
+	b.names++
+	return fmt.Sprintf("%s-%d", prefix, b.names)
+}
+
+func (b *MemoryBroker) routeLocked(e *memExchange, key string) []*memQueue {
+	if e.name == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*memQueue{q}
+		}
+		return nil
+	}
+	seen := map[*memQueue]struct{}{}
+	queues := []*memQueue{}
+	for _, bnd := range e.bindings {
+		if _, ok := seen[bnd.queue]; ok || !e.matches(bnd.key, key) {
+			continue
+		}
+		seen[bnd.queue] = struct{}{}
+		queues = append(queues, bnd.queue)
+	}
+	return queues
+}
+
+// publishLocked routes pub to the queues bound to e, returning how many it
+// was routed to and whether every one of them accepted it.
+// Messages an alternate exchange routes keep the exchange they were
+// published to.
+func (b *MemoryBroker) publishLocked(e *memExchange, key string, pub amqp.Publishing) (int, bool) {
+	queues := b.routeLocked(e, key)
+	if len(queues) == 0 {
+		if ae, ok := e.args["alternate-exchange"].(string); ok {
+			if alt, ok := b.exchanges[ae]; ok && alt != e {
+				queues = b.routeLocked(alt, key)
+			}
+		}
+	}
+	accepted := true
+	for _, q := range queues {
+		ok := b.enqueueLocked(q, &memMessage{
+			exchange: e.name,
+			key:      key,
+			pub:      clonePublishing(pub),
+		})
+		accepted = accepted && ok
+	}
+	return len(queues), accepted
+}
+
+// enqueueLocked appends m to q, reporting false if q is at its x-max-length
+// and its x-overflow rejects new messages.
+func (b *MemoryBroker) enqueueLocked(q *memQueue, m *memMessage) bool {
+	if q.stream {
+		if m.pub.Headers == nil {
+			m.pub.Headers = amqp.Table{}
+		}
+		m.pub.Headers[HeaderStreamOffset] = int64(len(q.log))
+		m.appended = time.Now()
+		q.log = append(q.log, m)
+		b.dispatchLocked(q)
+		return true
+	}
+	b.expireLocked(q)
+	if max, ok := tableInt(q.args["x-max-length"]); ok && int64(len(q.ready)) >= max {
+		switch q.args["x-overflow"] {
+		case OverflowRejectPublish:
+			return false
+		case OverflowRejectPublishDLX:
+			b.deadLetterLocked(q, m, "maxlen")
+			return false
+		}
+		for len(q.ready) > 0 && int64(len(q.ready)) >= max {
+			head := q.ready[0]
+			q.ready = q.ready[1:]
+			b.deadLetterLocked(q, head, "maxlen")
+		}
+	}
+	if ttl, ok := messageTTL(q, m); ok {
+		m.expires = time.Now().Add(ttl)
+	}
+	q.ready = append(q.ready, m)
+	b.scheduleExpiryLocked(q, m)
+	b.dispatchLocked(q)
+	return true
+}
+
+// requeueLocked puts m back at the head of q after a nack or a closed
+// channel.
+func (b *MemoryBroker) requeueLocked(q *memQueue, m *memMessage) {
+	if q.stream {
+		return
+	}
+	m.redelivered = true
+	q.ready = append([]*memMessage{m}, q.ready...)
+	b.scheduleExpiryLocked(q, m)
+}
+
+func (b *MemoryBroker) dispatchLocked(q *memQueue) {
+	if q.stream {
+		// Every consumer of a stream reads all of it from its own offset.
+		for _, c := range q.consumers {
+			for c.offset < int64(len(q.log)) && c.hasCapacity() {
+				m := q.log[c.offset]
+				c.offset++
+				c.deliverLocked(m)
+			}
+		}
+		return
+	}
+	b.expireLocked(q)
+	for len(q.ready) > 0 {
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+		c.deliverLocked(m)
+	}
+}
+
+func (b *MemoryBroker) scheduleExpiryLocked(q *memQueue, m *memMessage) {
+	if m.expires.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(m.expires), func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.dispatchLocked(q)
+	})
+}
+
+// expireLocked dead-letters the ready messages of q whose TTL has passed.
+func (b *MemoryBroker) expireLocked(q *memQueue) {
+	if q.deleted {
+		return
+	}
+	now := time.Now()
+	ready := q.ready[:0]
+	expired := []*memMessage{}
+	for _, m := range q.ready {
+		if !m.expires.IsZero() && !m.expires.After(now) {
+			expired = append(expired, m)
+			continue
+		}
+		ready = append(ready, m)
+	}
+	q.ready = ready
+	for _, m := range expired {
+		b.deadLetterLocked(q, m, "expired")
+	}
+}
+
+// messageTTL is the lower of the queue's x-message-ttl and the message's
+// expiration, if either is set.
+func messageTTL(q *memQueue, m *memMessage) (time.Duration, bool) {
+	ttl, ok := time.Duration(0), false
+	if ms, isInt := tableInt(q.args["x-message-ttl"]); isInt {
+		ttl, ok = time.Duration(ms)*time.Millisecond, true
+	}
+	if ms, err := strconv.ParseInt(m.pub.Expiration, 10, 64); err == nil {
+		if d := time.Duration(ms) * time.Millisecond; !ok || d < ttl {
+			ttl, ok = d, true
+		}
+	}
+	return ttl, ok
+}
+
+func (b *MemoryBroker) deadLetterLocked(q *memQueue, m *memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	e, ok := b.exchanges[dlx]
+	if !ok {
+		return
+	}
+	key := m.key
+	if rk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = rk
+	}
+	pub := clonePublishing(m.pub)
+	pub.Headers = withDeath(pub.Headers, q.name, reason, m.exchange, m.key, pub.Expiration)
+	pub.Expiration = ""
+	b.publishLocked(e, key, pub)
+}
+
+func (b *MemoryBroker) deleteQueueLocked(q *memQueue) {
+	if q.deleted {
+		return
+	}
+	q.deleted = true
+	delete(b.queues, q.name)
+	for _, e := range b.exchanges {
+		bindings := e.bindings[:0]
+		for _, bnd := range e.bindings {
+			if bnd.queue != q {
+				bindings = append(bindings, bnd)
+			}
+		}
+		e.bindings = bindings
+	}
+	for _, c := range append([]*memConsumer(nil), q.consumers...) {
+		c.cancelLocked()
+	}
+}
+
+// MemoryConnection is a Broker connected to a MemoryBroker.
+type MemoryConnection struct {
+	broker   *MemoryBroker
+	channels map[*memChannel]struct{}
+	notify   []chan *amqp.Error
+	closed   bool
+}
+
+func (c *MemoryConnection) Channel() (Channel, error) {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memChannel{
+		broker:    b,
+		conn:      c,
+		consumers: map[string]*memConsumer{},
+		unacked:   map[uint64]*memUnacked{},
+	}
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (c *MemoryConnection) Close() error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.closeLocked(nil)
+	return nil
+}
+
+func (c *MemoryConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b := c.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c.closed {
+		close(receiver)
+	} else {
+		c.notify = append(c.notify, receiver)
+	}
+	return receiver
+}
+
+// closeLocked closes the connection, reporting err to NotifyClose receivers
+// unless it is nil for a graceful close.
+func (c *MemoryConnection) closeLocked(err *amqp.Error) {
+	b := c.broker
+	c.closed = true
+	for ch := range c.channels {
+		ch.closeLocked()
+	}
+	for _, q := range b.queues {
+		if q.exclusive && q.owner == c {
+			b.deleteQueueLocked(q)
+		}
+	}
+	delete(b.conns, c)
+	for _, receiver := range c.notify {
+		if err != nil {
+			select {
+			case receiver <- err:
+			default:
+			}
+		}
+		close(receiver)
+	}
+	c.notify = nil
+}
+
+type memExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	args       amqp.Table
+	bindings   []memBinding
+}
+
+type memBinding struct {
+	queue *memQueue
+	key   string
+}
+
+func (e *memExchange) matches(pattern, key string) bool {
+	switch e.kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatch(strings.Split(pattern, "."), strings.Split(key, "."))
+	default:
+		return pattern == key
+	}
+}
+
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+	}
+}
+
+type memQueue struct {
+	name         string
+	durable      bool
+	autoDelete   bool
+	exclusive    bool
+	owner        *MemoryConnection
+	args         amqp.Table
+	ready        []*memMessage
+	consumers    []*memConsumer
+	next         int
+	hadConsumers bool
+	deleted      bool
+
+	// Streams keep every message in log instead of ready.
+	stream bool
+	log    []*memMessage
+}
+
+func (q *memQueue) nextConsumer() *memConsumer {
+	for i := range q.consumers {
+		idx := (q.next + i) % len(q.consumers)
+		if c := q.consumers[idx]; c.hasCapacity() {
+			q.next = (idx + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
+
+func (q *memQueue) info() amqp.Queue {
+	if q.stream {
+		return amqp.Queue{Name: q.name, Messages: len(q.log), Consumers: len(q.consumers)}
+	}
+	return amqp.Queue{Name: q.name, Messages: len(q.ready), Consumers: len(q.consumers)}
+}
+
+// streamOffset is where a consumer of the stream q starts reading for the
+// x-stream-offset consumer argument spec.
+func (q *memQueue) streamOffset(spec any) (int64, bool) {
+	end := int64(len(q.log))
+	switch spec := spec.(type) {
+	case nil:
+		return end, true
+	case string:
+		switch spec {
+		case "first":
+			return 0, true
+		case "last":
+			return max(end-1, 0), true
+		case "next":
+			return end, true
+		}
+		return 0, false
+	case time.Time:
+		for i, m := range q.log {
+			if !m.appended.Before(spec) {
+				return int64(i), true
+			}
+		}
+		return end, true
+	}
+	n, ok := tableInt(spec)
+	if !ok || n < 0 {
+		return 0, false
+	}
+	return min(n, end), true
+}
+
+// queue arguments that must match when a queue is redeclared
+var equivalentQueueArgs = []string{
+	"x-dead-letter-exchange",
+	"x-dead-letter-routing-key",
+	"x-message-ttl",
+	"x-expires",
+	"x-max-length",
+	"x-overflow",
+	"x-queue-type",
+	"x-single-active-consumer",
+	"x-max-age",
+}
+
+type memMessage struct {
+	exchange    string
+	key         string
+	pub         amqp.Publishing
+	redelivered bool
+	expires     time.Time
+	appended    time.Time
+}
+
+func (m *memMessage) delivery(ack amqp.Acknowledger, consumerTag string, tag uint64) amqp.Delivery {
+	p := m.pub
+	return amqp.Delivery{
+		Acknowledger:    ack,
+		Headers:         cloneTable(p.Headers),
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            append([]byte(nil), p.Body...),
+	}
+}
+
+type memConsumer struct {
+	tag        string
+	ch         *memChannel
+	queue      *memQueue
+	autoAck    bool
+	exclusive  bool
+	prefetch   int
+	inflight   int
+	offset     int64
+	pending    []memPending
+	wake       chan struct{}
+	done       chan struct{}
+	deliveries chan amqp.Delivery
+}
+
+type memPending struct {
+	delivery amqp.Delivery
+	msg      *memMessage
+}
+
+func (c *memConsumer) hasCapacity() bool {
+	return c.autoAck || c.prefetch == 0 || c.inflight < c.prefetch
+}
+
+func (c *memConsumer) deliverLocked(m *memMessage) {
+	ch := c.ch
+	ch.deliveryTag++
+	tag := ch.deliveryTag
+	if !c.autoAck {
+		ch.unacked[tag] = &memUnacked{queue: c.queue, msg: m, consumer: c}
+		c.inflight++
+	}
+	c.pending = append(c.pending, memPending{delivery: m.delivery(ch, c.tag, tag), msg: m})
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *memConsumer) run() {
+	b := c.ch.broker
+	defer close(c.deliveries)
+	for {
+		b.mu.Lock()
+		if len(c.pending) == 0 {
+			b.mu.Unlock()
+			select {
+			case <-c.wake:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+		p := c.pending[0]
+		c.pending = c.pending[1:]
+		b.mu.Unlock()
+
+		select {
+		case c.deliveries <- p.delivery:
+		case <-c.done:
+			b.mu.Lock()
+			c.ch.requeueLocked(p.delivery.DeliveryTag)
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *memConsumer) cancelLocked() {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	b := c.ch.broker
+	q := c.queue
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	delete(c.ch.consumers, c.tag)
+	close(c.done)
+
+	for i := len(c.pending) - 1; i >= 0; i-- {
+		p := c.pending[i]
+		if c.autoAck {
+			b.requeueLocked(q, p.msg)
+			continue
+		}
+		c.ch.requeueLocked(p.delivery.DeliveryTag)
+	}
+	c.pending = nil
+
+	if q.autoDelete && q.hadConsumers && len(q.consumers) == 0 {
+		b.deleteQueueLocked(q)
+		return
+	}
+	b.dispatchLocked(q)
+}
+
+// memUnacked is a delivery awaiting its ack. consumer is nil for messages
+// fetched with Get.
+type memUnacked struct {
+	queue    *memQueue
+	msg      *memMessage
+	consumer *memConsumer
+}
+
+func (u *memUnacked) settle() {
+	if u.consumer != nil {
+		u.consumer.inflight--
+	}
+}
+
+type memChannel struct {
+	broker      *MemoryBroker
+	conn        *MemoryConnection
+	prefetch    int
+	deliveryTag uint64
+	consumers   map[string]*memConsumer
+	unacked     map[uint64]*memUnacked
+	closed      bool
+	replyQueue  string
+
+	confirming   bool
+	publishSeq   uint64
+	confirms     []amqp.Confirmation
+	confirmNotes []chan amqp.Confirmation
+	returns      []amqp.Return
+	returnNotes  []chan amqp.Return
+	notifying    bool
+	notifyWake   chan struct{}
+}
+
+var _ Channel = (*memChannel)(nil)
+
+func (ch *memChannel) failLocked(code int, format string, args ...any) error {
+	ch.closeLocked()
+	return &amqp.Error{Code: code, Reason: fmt.Sprintf(format, args...), Server: true}
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.closeLocked()
+	return nil
+}
+
+func (ch *memChannel) closeLocked() {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	for _, c := range ch.consumers {
+		c.cancelLocked()
+	}
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		ch.requeueLocked(tag)
+	}
+	delete(ch.conn.channels, ch)
+	if ch.notifying {
+		ch.wakeNotifierLocked()
+	} else {
+		for _, receiver := range ch.confirmNotes {
+			close(receiver)
+		}
+		ch.confirmNotes = nil
+		for _, receiver := range ch.returnNotes {
+			close(receiver)
+		}
+		ch.returnNotes = nil
+	}
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirming = true
+	ch.startNotifierLocked()
+	return nil
+}
+
+func (ch *memChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(returns)
+	} else {
+		ch.returnNotes = append(ch.returnNotes, returns)
+		ch.startNotifierLocked()
+	}
+	return returns
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(confirm)
+	} else {
+		ch.confirmNotes = append(ch.confirmNotes, confirm)
+	}
+	return confirm
+}
+
+func (ch *memChannel) confirmLocked(ack bool) {
+	ch.publishSeq++
+	ch.confirms = append(ch.confirms, amqp.Confirmation{DeliveryTag: ch.publishSeq, Ack: ack})
+	ch.wakeNotifierLocked()
+}
+
+func (ch *memChannel) returnLocked(exchange, key string, msg amqp.Publishing) {
+	if len(ch.returnNotes) == 0 {
+		return
+	}
+	ch.returns = append(ch.returns, amqp.Return{
+		ReplyCode:       amqp.NoRoute,
+		ReplyText:       "NO_ROUTE",
+		Exchange:        exchange,
+		RoutingKey:      key,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		Headers:         cloneTable(msg.Headers),
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            append([]byte(nil), msg.Body...),
+	})
+	ch.wakeNotifierLocked()
+}
+
+func (ch *memChannel) startNotifierLocked() {
+	if ch.notifying {
+		return
+	}
+	ch.notifying = true
+	ch.notifyWake = make(chan struct{}, 1)
+	go ch.runNotifier()
+}
+
+func (ch *memChannel) wakeNotifierLocked() {
+	select {
+	case ch.notifyWake <- struct{}{}:
+	default:
+	}
+}
+
+// runNotifier delivers returns and publisher confirms outside the broker
+// lock, each return before the confirm of its message, closing the
+// receivers once the channel is closed.
+func (ch *memChannel) runNotifier() {
+	b := ch.broker
+	for {
+		b.mu.Lock()
+		returns, confirms := ch.returns, ch.confirms
+		ch.returns, ch.confirms = nil, nil
+		returnNotes := append([]chan amqp.Return(nil), ch.returnNotes...)
+		confirmNotes := append([]chan amqp.Confirmation(nil), ch.confirmNotes...)
+		closed := ch.closed
+		if closed && len(returns) == 0 && len(confirms) == 0 {
+			ch.returnNotes, ch.confirmNotes = nil, nil
+		}
+		b.mu.Unlock()
+
+		for _, r := range returns {
+			for _, receiver := range returnNotes {
+				receiver <- r
+			}
+		}
+		for _, c := range confirms {
+			for _, receiver := range confirmNotes {
+				receiver <- c
+			}
+		}
+		if len(returns) > 0 || len(confirms) > 0 {
+			continue
+		}
+		if closed {
+			for _, receiver := range returnNotes {
+				close(receiver)
+			}
+			for _, receiver := range confirmNotes {
+				close(receiver)
+			}
+			return
+		}
+		<-ch.notifyWake
+	}
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if e, ok := b.exchanges[name]; ok {
+		if e.kind != kind {
+			return ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s'", name)
+		}
+		if e.durable != durable {
+			return ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg 'durable' for exchange '%s'", name)
+		}
+		if fmt.Sprint(e.args["alternate-exchange"]) != fmt.Sprint(args["alternate-exchange"]) {
+			return ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg 'alternate-exchange' for exchange '%s'", name)
+		}
+		return nil
+	}
+	if name == "" || strings.HasPrefix(name, "amq.") {
+		return ch.failLocked(amqp.AccessRefused, "ACCESS_REFUSED - exchange name '%s' contains reserved prefix 'amq.*'", name)
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic:
+	default:
+		return ch.failLocked(amqp.CommandInvalid, "COMMAND_INVALID - invalid exchange type '%s'", kind)
+	}
+	b.exchanges[name] = &memExchange{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+		args:       cloneTable(args),
+	}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		name = b.nextName("amq.gen")
+	}
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+		}
+		if q.durable != durable {
+			return amqp.Queue{}, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg 'durable' for queue '%s'", name)
+		}
+		for _, arg := range equivalentQueueArgs {
+			if fmt.Sprint(q.args[arg]) != fmt.Sprint(args[arg]) {
+				return amqp.Queue{}, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg '%s' for queue '%s'", arg, name)
+			}
+		}
+		return q.info(), nil
+	}
+	if strings.HasPrefix(name, "amq.") && !strings.HasPrefix(name, "amq.gen-") {
+		return amqp.Queue{}, ch.failLocked(amqp.AccessRefused, "ACCESS_REFUSED - queue name '%s' contains reserved prefix 'amq.*'", name)
+	}
+	if v, ok := args["x-max-length"]; ok {
+		if n, isInt := tableInt(v); !isInt || n < 0 {
+			return amqp.Queue{}, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - invalid arg 'x-max-length' for queue '%s': %v", name, v)
+		}
+	}
+	if v, ok := args["x-overflow"]; ok {
+		switch v {
+		case OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDLX:
+		default:
+			return amqp.Queue{}, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - invalid arg 'x-overflow' for queue '%s': %v", name, v)
+		}
+	}
+	q := &memQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       cloneTable(args),
+		stream:     args["x-queue-type"] == string(Stream),
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+	return q.info(), nil
+}
+
+func (ch *memChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[name]; !ok {
+		return ch.failLocked(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", name)
+	}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return amqp.Queue{}, ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+	}
+	return q.info(), nil
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return ch.failLocked(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", exchange)
+	}
+	if exchange == "" {
+		return ch.failLocked(amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange")
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+	}
+	for _, bnd := range e.bindings {
+		if bnd.queue == q && bnd.key == key {
+			return nil
+		}
+	}
+	e.bindings = append(e.bindings, memBinding{queue: q, key: key})
+	return nil
+}
+
+func (ch *memChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return ch.failLocked(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", exchange)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+	}
+	for i, bnd := range e.bindings {
+		if bnd.queue == q && bnd.key == key {
+			e.bindings = append(e.bindings[:i], e.bindings[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (ch *memChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return 0, ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+	}
+	n := q.info().Messages
+	if ifUnused && len(q.consumers) > 0 {
+		return 0, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' in vhost '/' in use", name)
+	}
+	if ifEmpty && n > 0 {
+		return 0, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' in vhost '/' is not empty", name)
+	}
+	b.deleteQueueLocked(q)
+	return n, nil
+}
+
+func (ch *memChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return 0, ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name)
+	}
+	n := len(q.ready)
+	q.ready = nil
+	return n, nil
+}
+
+func (ch *memChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return amqp.Delivery{}, false, ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue)
+	}
+	if q.stream {
+		return amqp.Delivery{}, false, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' in vhost '/' is a stream, basic.get is not supported", queue)
+	}
+	b.expireLocked(q)
+	if len(q.ready) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	m := q.ready[0]
+	q.ready = q.ready[1:]
+	ch.deliveryTag++
+	if !autoAck {
+		ch.unacked[ch.deliveryTag] = &memUnacked{queue: q, msg: m}
+	}
+	d := m.delivery(ch, "", ch.deliveryTag)
+	d.MessageCount = uint32(len(q.ready))
+	return d, true, nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if prefetchSize != 0 {
+		return ch.failLocked(amqp.NotImplemented, "NOT_IMPLEMENTED - prefetch_size!=0 (%d)", prefetchSize)
+	}
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	// Consuming DirectReplyTo creates a queue for the channel's replies, and
+	// publishing with it as ReplyTo substitutes that queue's name.
+	if queue == DirectReplyTo {
+		if !autoAck {
+			return nil, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer cannot acknowledge")
+		}
+		if _, ok := b.queues[ch.replyQueue]; ok {
+			return nil, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - reply consumer already set")
+		}
+		queue = b.nextName(DirectReplyTo)
+		b.queues[queue] = &memQueue{name: queue, autoDelete: true, exclusive: true, owner: ch.conn}
+		ch.replyQueue = queue
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, ch.failLocked(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", queue)
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, ch.failLocked(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue)
+	}
+	if consumer == "" {
+		consumer = b.nextName("amq.ctag")
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, ch.failLocked(amqp.NotAllowed, "NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer)
+	}
+	for _, other := range q.consumers {
+		if exclusive || other.exclusive {
+			return nil, ch.failLocked(amqp.AccessRefused, "ACCESS_REFUSED - queue '%s' in vhost '/' in exclusive use", queue)
+		}
+	}
+	var offset int64
+	if q.stream {
+		if autoAck {
+			return nil, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - stream consumers must acknowledge messages")
+		}
+		if ch.prefetch == 0 {
+			return nil, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - consumer prefetch count is not set for '%s'", queue)
+		}
+		var ok bool
+		if offset, ok = q.streamOffset(args[HeaderStreamOffset]); !ok {
+			return nil, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - invalid stream offset %v", args[HeaderStreamOffset])
+		}
+	}
+	c := &memConsumer{
+		tag:        consumer,
+		ch:         ch,
+		queue:      q,
+		autoAck:    autoAck,
+		exclusive:  exclusive,
+		prefetch:   ch.prefetch,
+		offset:     offset,
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		deliveries: make(chan amqp.Delivery),
+	}
+	q.consumers = append(q.consumers, c)
+	q.hadConsumers = true
+	ch.consumers[consumer] = c
+	go c.run()
+	b.dispatchLocked(q)
+	return c.deliveries, nil
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if c, ok := ch.consumers[consumer]; ok {
+		c.cancelLocked()
+	}
+	return nil
+}
+
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return ch.failLocked(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", exchange)
+	}
+	if immediate {
+		return ch.failLocked(amqp.NotImplemented, "NOT_IMPLEMENTED - immediate=true")
+	}
+	if msg.ReplyTo == DirectReplyTo {
+		if _, ok := b.queues[ch.replyQueue]; !ok {
+			return ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - fast reply consumer does not exist")
+		}
+		msg.ReplyTo = ch.replyQueue
+	}
+	n, accepted := b.publishLocked(e, key, msg)
+	if n == 0 && mandatory {
+		ch.returnLocked(exchange, key, msg)
+	}
+	if ch.confirming {
+		ch.confirmLocked(accepted)
+	}
+	return nil
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	settled, err := ch.takeLocked(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for _, u := range settled {
+		b.dispatchLocked(u.queue)
+	}
+	return nil
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	settled, err := ch.takeLocked(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for i := len(settled) - 1; i >= 0; i-- {
+		u := settled[i]
+		if u.queue.deleted {
+			continue
+		}
+		if requeue {
+			b.requeueLocked(u.queue, u.msg)
+		} else {
+			b.deadLetterLocked(u.queue, u.msg, "rejected")
+		}
+	}
+	for _, u := range settled {
+		b.dispatchLocked(u.queue)
+	}
+	return nil
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// takeLocked removes the unacknowledged deliveries covered by tag, in
+// delivery order.
+func (ch *memChannel) takeLocked(tag uint64, multiple bool) ([]*memUnacked, error) {
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	tags := []uint64{}
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return nil, ch.failLocked(amqp.PreconditionFailed, "PRECONDITION_FAILED - unknown delivery tag %d", tag)
+	}
+	settled := make([]*memUnacked, 0, len(tags))
+	for _, t := range tags {
+		u := ch.unacked[t]
+		delete(ch.unacked, t)
+		u.settle()
+		settled = append(settled, u)
+	}
+	return settled, nil
+}
+
+func (ch *memChannel) requeueLocked(tag uint64) {
+	u, ok := ch.unacked[tag]
+	if !ok {
+		return
+	}
+	delete(ch.unacked, tag)
+	u.settle()
+	if u.queue.deleted {
+		return
+	}
+	ch.broker.requeueLocked(u.queue, u.msg)
+	ch.broker.dispatchLocked(u.queue)
+}
+
+func withDeath(headers amqp.Table, queue, reason, exchange, key, expiration string) amqp.Table {
+	h := cloneTable(headers)
+	if h == nil {
+		h = amqp.Table{}
+	}
+	deaths, _ := h["x-death"].([]interface{})
+	count := int64(1)
+	rest := make([]interface{}, 0, len(deaths)+1)
+	for _, d := range deaths {
+		if t, ok := d.(amqp.Table); ok && t["queue"] == queue && t["reason"] == reason {
+			if n, ok := t["count"].(int64); ok {
+				count = n + 1
+			}
+			continue
+		}
+		rest = append(rest, d)
+	}
+	entry := amqp.Table{
+		"count":        count,
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now(),
+		"exchange":     exchange,
+		"routing-keys": []interface{}{key},
+	}
+	if expiration != "" {
+		entry["original-expiration"] = expiration
+	}
+	h["x-death"] = append([]interface{}{entry}, rest...)
+	if _, ok := h["x-first-death-reason"]; !ok {
+		h["x-first-death-reason"] = reason
+		h["x-first-death-queue"] = queue
+		h["x-first-death-exchange"] = exchange
+	}
+	return h
+}
+
+// tableInt reads an integer argument or header of any integer type.
+func tableInt(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func clonePublishing(p amqp.Publishing) amqp.Publishing {
+	p.Headers = cloneTable(p.Headers)
+	p.Body = append([]byte(nil), p.Body...)
+	return p
+}
+
+func cloneTable(t amqp.Table) amqp.Table {
+	if t == nil {
+		return nil
+	}
+	c := make(amqp.Table, len(t))
+	for k, v := range t {
+		c[k] = v
+	}
+	return c
+}
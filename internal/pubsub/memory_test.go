@@ -0,0 +1,307 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func memChannelOf(t *testing.T, b *MemoryBroker) Channel {
+	t.Helper()
+	ch, err := b.Connect().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func mustGet(t *testing.T, ch Channel, queue string) amqp.Delivery {
+	t.Helper()
+	msg, ok, err := ch.Get(queue, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("%s is empty", queue)
+	}
+	return msg
+}
+
+func publishTo(t *testing.T, ch Channel, exchange, key, body string) {
+	t.Helper()
+	err := ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryBrokerRouting(t *testing.T) {
+	tests := []struct {
+		kind    string
+		pattern string
+		key     string
+		routed  bool
+	}{
+		{amqp.ExchangeTopic, "army_moves.*", "army_moves.alice", true},
+		{amqp.ExchangeTopic, "army_moves.*", "army_moves", false},
+		{amqp.ExchangeTopic, "army_moves.*", "army_moves.alice.bob", false},
+		{amqp.ExchangeTopic, "army_moves.#", "army_moves", true},
+		{amqp.ExchangeTopic, "army_moves.#", "army_moves.alice.bob", true},
+		{amqp.ExchangeTopic, "#.bob", "army_moves.alice.bob", true},
+		{amqp.ExchangeTopic, "*.alice.#", "army_moves.alice", true},
+		{amqp.ExchangeTopic, "*.alice.#", "war.bob", false},
+		{amqp.ExchangeTopic, "#", "", true},
+		{amqp.ExchangeDirect, "pause", "pause", true},
+		{amqp.ExchangeDirect, "army_moves.*", "army_moves.alice", false},
+		{amqp.ExchangeFanout, "ignored", "anything", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind+" "+tt.pattern+" "+tt.key, func(t *testing.T) {
+			ch := memChannelOf(t, NewMemoryBroker())
+			if err := ch.ExchangeDeclare("peril", tt.kind, true, false, false, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ch.QueueDeclare("q", true, false, false, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := ch.QueueBind("q", tt.pattern, "peril", false, nil); err != nil {
+				t.Fatal(err)
+			}
+			publishTo(t, ch, "peril", tt.key, "hello")
+			_, ok, err := ch.Get("q", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.routed {
+				t.Errorf("routed = %v, want %v", ok, tt.routed)
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerNack(t *testing.T) {
+	ch := memChannelOf(t, NewMemoryBroker())
+	if err := ch.ExchangeDeclare("dlx", amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, args := range map[string]amqp.Table{
+		"dead": nil,
+		"work": {"x-dead-letter-exchange": "dlx"},
+	} {
+		if _, err := ch.QueueDeclare(name, true, false, false, false, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ch.QueueBind("dead", "", "dlx", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	publishTo(t, ch, "", "work", "hello")
+
+	msg := mustGet(t, ch, "work")
+	if msg.Redelivered {
+		t.Error("first delivery is marked redelivered")
+	}
+	if err := msg.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	msg = mustGet(t, ch, "work")
+	if !msg.Redelivered {
+		t.Error("requeued delivery isn't marked redelivered")
+	}
+	if err := msg.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := ch.Get("work", false); ok {
+		t.Fatal("rejected message is still in its queue")
+	}
+
+	dead := mustGet(t, ch, "dead")
+	if string(dead.Body) != "hello" {
+		t.Errorf("dead-lettered body = %q", dead.Body)
+	}
+	deaths, _ := dead.Headers["x-death"].([]interface{})
+	if len(deaths) != 1 {
+		t.Fatalf("x-death = %v, want one entry", dead.Headers["x-death"])
+	}
+	death := deaths[0].(amqp.Table)
+	if death["queue"] != "work" || death["reason"] != "rejected" || death["count"] != int64(1) {
+		t.Errorf("x-death = %v", death)
+	}
+}
+
+func TestMemoryBrokerExpiry(t *testing.T) {
+	ch := memChannelOf(t, NewMemoryBroker())
+	for name, args := range map[string]amqp.Table{
+		"work":      nil,
+		"work.wait": {"x-message-ttl": int64(10), "x-dead-letter-exchange": "", "x-dead-letter-routing-key": "work"},
+	} {
+		if _, err := ch.QueueDeclare(name, true, false, false, false, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publishTo(t, ch, "", "work.wait", "later")
+	if _, ok, _ := ch.Get("work", false); ok {
+		t.Fatal("message left the retry queue before its TTL")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	msg := mustGet(t, ch, "work")
+	if death := msg.Headers["x-death"].([]interface{})[0].(amqp.Table); death["reason"] != "expired" {
+		t.Errorf("x-death = %v, want expired", death)
+	}
+}
+
+func TestMemoryBrokerMaxLength(t *testing.T) {
+	tests := []struct {
+		overflow string
+		kept     []string
+		dead     []string
+		acked    []bool
+	}{
+		{OverflowDropHead, []string{"2", "3"}, []string{"1"}, []bool{true, true, true}},
+		{OverflowRejectPublish, []string{"1", "2"}, nil, []bool{true, true, false}},
+		{OverflowRejectPublishDLX, []string{"1", "2"}, []string{"3"}, []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.overflow, func(t *testing.T) {
+			ch := memChannelOf(t, NewMemoryBroker())
+			if err := ch.ExchangeDeclare("dlx", amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+				t.Fatal(err)
+			}
+			for name, args := range map[string]amqp.Table{
+				"dead": nil,
+				"work": {"x-dead-letter-exchange": "dlx", "x-max-length": int64(2), "x-overflow": tt.overflow},
+			} {
+				if _, err := ch.QueueDeclare(name, true, false, false, false, args); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ch.QueueBind("dead", "", "dlx", false, nil); err != nil {
+				t.Fatal(err)
+			}
+			c := ch.(confirmer)
+			if err := c.Confirm(false); err != nil {
+				t.Fatal(err)
+			}
+			confirms := c.NotifyPublish(make(chan amqp.Confirmation, 3))
+			for _, body := range []string{"1", "2", "3"} {
+				publishTo(t, ch, "", "work", body)
+			}
+			for i, want := range tt.acked {
+				if got := <-confirms; got.Ack != want {
+					t.Errorf("publish %d acked = %v, want %v", i+1, got.Ack, want)
+				}
+			}
+
+			for queue, want := range map[string][]string{"work": tt.kept, "dead": tt.dead} {
+				var got []string
+				for {
+					msg, ok, err := ch.Get(queue, true)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !ok {
+						break
+					}
+					got = append(got, string(msg.Body))
+					if queue == "dead" && msg.Headers["x-first-death-reason"] != "maxlen" {
+						t.Errorf("dead-lettered for %v, want maxlen", msg.Headers["x-first-death-reason"])
+					}
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("%s holds %v, want %v", queue, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerRejectsBadLengthLimits(t *testing.T) {
+	for _, args := range []amqp.Table{
+		{"x-max-length": int64(-1)},
+		{"x-max-length": "10"},
+		{"x-overflow": "drop-tail"},
+	} {
+		ch := memChannelOf(t, NewMemoryBroker())
+		_, err := ch.QueueDeclare("work", true, false, false, false, args)
+		var amqpErr *amqp.Error
+		if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+			t.Errorf("declaring with %v: err = %v, want PRECONDITION_FAILED", args, err)
+		}
+	}
+}
+
+func TestMemoryBrokerStreamOffsets(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset func(mark time.Time) any
+		want   []int64
+	}{
+		{"default", func(time.Time) any { return nil }, []int64{5}},
+		{"first", func(time.Time) any { return "first" }, []int64{0, 1, 2, 3, 4, 5}},
+		{"last", func(time.Time) any { return "last" }, []int64{4, 5}},
+		{"next", func(time.Time) any { return "next" }, []int64{5}},
+		{"offset", func(time.Time) any { return int64(2) }, []int64{2, 3, 4, 5}},
+		{"past the end", func(time.Time) any { return int64(99) }, []int64{5}},
+		{"timestamp", func(mark time.Time) any { return mark }, []int64{3, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := memChannelOf(t, NewMemoryBroker())
+			if _, err := ch.QueueDeclare("log", true, false, false, false, amqp.Table{"x-queue-type": string(Stream)}); err != nil {
+				t.Fatal(err)
+			}
+			var mark time.Time
+			for i := 0; i < 5; i++ {
+				if i == 3 {
+					time.Sleep(5 * time.Millisecond)
+					mark = time.Now()
+				}
+				publishTo(t, ch, "", "log", "old")
+			}
+			if err := ch.Qos(10, 0, false); err != nil {
+				t.Fatal(err)
+			}
+			args := amqp.Table{}
+			if spec := tt.offset(mark); spec != nil {
+				args[HeaderStreamOffset] = spec
+			}
+			deliveries, err := ch.Consume("log", "", false, false, false, false, args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			publishTo(t, ch, "", "log", "new")
+
+			var got []int64
+			for msg := range deliveries {
+				offset, _ := tableInt(msg.Headers[HeaderStreamOffset])
+				got = append(got, offset)
+				if string(msg.Body) == "new" {
+					break
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("read offsets %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerStreamRejectsBadOffset(t *testing.T) {
+	ch := memChannelOf(t, NewMemoryBroker())
+	if _, err := ch.QueueDeclare("log", true, false, false, false, amqp.Table{"x-queue-type": string(Stream)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Qos(10, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ch.Consume("log", "", false, false, false, false, amqp.Table{HeaderStreamOffset: "yesterday"})
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Errorf("err = %v, want PRECONDITION_FAILED", err)
+	}
+}
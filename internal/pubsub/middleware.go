@@ -0,0 +1,206 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// Handler handles one decoded message. A nil error settles the message as
+// acktype says; otherwise the error's ErrorClass decides, and acktype is
+// ignored.
+type Handler[T any] func(ctx context.Context, value T, meta Metadata) (AckType, error)
+
+// Middleware wraps a Handler with behaviour shared between subscriptions.
+type Middleware[T any] func(Handler[T]) Handler[T]
+
+// Chain wraps h in mws, the first being the outermost.
+func Chain[T any](h Handler[T], mws ...Middleware[T]) Handler[T] {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// WithMiddleware wraps the subscription's handler in mws, the first being
+// the outermost. The middleware must be for the subscription's message
+// type.
+func WithMiddleware[T any](mws ...Middleware[T]) SubscribeOption {
+	return func(o *subscribeOptions) {
+		for _, mw := range mws {
+			o.middleware = append(o.middleware, mw)
+		}
+	}
+}
+
+// Recover turns a panicking handler into a Permanent error, logging the
+// panic and its stack.
+func Recover[T any]() Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, value T, meta Metadata) (acktype AckType, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					stack := debug.Stack()
+					if p, ok := r.(handlerPanic); ok {
+						r, stack = p.value, p.stack
+					}
+					slog.Error("handler panicked",
+						"message_id", meta.MessageID,
+						"routing_key", meta.RoutingKey,
+						"panic", fmt.Sprint(r),
+						"stack", string(stack),
+					)
+					err = Permanent(fmt.Errorf("handler panicked: %v", r))
+				}
+			}()
+			return next(ctx, value, meta)
+		}
+	}
+}
+
+// handlerPanic carries a panic from the goroutine Timeout runs a handler in
+// to the caller's, keeping the stack where it happened.
+type handlerPanic struct {
+	value any
+	stack []byte
+}
+
+func (p handlerPanic) String() string {
+	return fmt.Sprintf("%v\n%s", p.value, p.stack)
+}
+
+// Logging logs every handled message with its outcome and how long it took.
+func Logging[T any](logger *slog.Logger) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, value T, meta Metadata) (AckType, error) {
+			start := time.Now()
+			acktype, err := next(ctx, value, meta)
+			attrs := []any{
+				"message_id", meta.MessageID,
+				"correlation_id", meta.CorrelationID,
+				"type", meta.Type,
+				"routing_key", meta.RoutingKey,
+				"redelivered", meta.Redelivered,
+				"ack", string(outcome(acktype, err)),
+				"duration", time.Since(start),
+			}
+			if err != nil {
+				attrs = append(attrs, "error", err.Error(), "error_class", string(ClassOf(err)))
+			}
+			logger.InfoContext(ctx, "handled message", attrs...)
+			return acktype, err
+		}
+	}
+}
+
+// Timing reports how long each message took to handle to observe.
+func Timing[T any](observe func(meta Metadata, d time.Duration)) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, value T, meta Metadata) (AckType, error) {
+			start := time.Now()
+			defer func() {
+				observe(meta, time.Since(start))
+			}()
+			return next(ctx, value, meta)
+		}
+	}
+}
+
+// HandlerMetrics counts handled messages by outcome. Its String method
+// reports them as JSON, so it can be published with expvar.
+type HandlerMetrics struct {
+	Acked     atomic.Int64
+	Requeued  atomic.Int64
+	Discarded atomic.Int64
+	Busy      atomic.Int64
+	// TotalTime is the sum of handling times in nanoseconds.
+	TotalTime atomic.Int64
+}
+
+func (m *HandlerMetrics) String() string {
+	data, _ := json.Marshal(map[string]int64{
+		"acked":         m.Acked.Load(),
+		"requeued":      m.Requeued.Load(),
+		"discarded":     m.Discarded.Load(),
+		"busy":          m.Busy.Load(),
+		"total_time_ns": m.TotalTime.Load(),
+	})
+	return string(data)
+}
+
+// Metrics records the outcome and duration of every handled message in m.
+func Metrics[T any](m *HandlerMetrics) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, value T, meta Metadata) (AckType, error) {
+			m.Busy.Add(1)
+			start := time.Now()
+			acktype, err := next(ctx, value, meta)
+			m.TotalTime.Add(int64(time.Since(start)))
+			m.Busy.Add(-1)
+			switch outcome(acktype, err) {
+			case Ack:
+				m.Acked.Add(1)
+			case NackRequeue:
+				m.Requeued.Add(1)
+			default:
+				m.Discarded.Add(1)
+			}
+			return acktype, err
+		}
+	}
+}
+
+// Timeout gives the handler d to finish. Its context is cancelled after d,
+// and if it still hasn't returned it fails with a Retryable error. The
+// handler isn't stopped: its goroutine keeps running until it returns,
+// possibly while the message is redelivered, and whatever it returns or
+// panics with then is dropped. Handlers should watch their context.
+//
+// A panic before the deadline is raised again in the caller's goroutine, so
+// Recover placed outside Timeout catches it.
+func Timeout[T any](d time.Duration) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, value T, meta Metadata) (AckType, error) {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			type result struct {
+				acktype AckType
+				err     error
+			}
+			done := make(chan result, 1)
+			panicked := make(chan handlerPanic, 1)
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						panicked <- handlerPanic{value: r, stack: debug.Stack()}
+					}
+				}()
+				acktype, err := next(ctx, value, meta)
+				done <- result{acktype, err}
+			}()
+			select {
+			case r := <-done:
+				return r.acktype, r.err
+			case p := <-panicked:
+				panic(p)
+			case <-ctx.Done():
+				return NackRequeue, Retryable(fmt.Errorf("handler timed out after %s", d))
+			}
+		}
+	}
+}
+
+// Prompt prints prompt after each message is handled, redrawing the REPL
+// prompt that the handler's output scrolled away.
+func Prompt[T any](prompt string) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, value T, meta Metadata) (AckType, error) {
+			defer fmt.Print(prompt)
+			return next(ctx, value, meta)
+		}
+	}
+}
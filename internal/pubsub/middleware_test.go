@@ -0,0 +1,136 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware[note] {
+		return func(next Handler[note]) Handler[note] {
+			return func(ctx context.Context, n note, meta Metadata) (AckType, error) {
+				calls = append(calls, name+" in")
+				defer func() { calls = append(calls, name+" out") }()
+				return next(ctx, n, meta)
+			}
+		}
+	}
+	h := Chain(func(context.Context, note, Metadata) (AckType, error) {
+		calls = append(calls, "handler")
+		return Ack, nil
+	}, record("first"), record("second"))
+	if _, err := h(context.Background(), note{}, Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"first in", "second in", "handler", "second out", "first out"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("called %v, want %v", calls, want)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	var took time.Duration
+	h := Chain(func(context.Context, note, Metadata) (AckType, error) {
+		time.Sleep(10 * time.Millisecond)
+		return Ack, nil
+	}, Timing[note](func(_ Metadata, d time.Duration) { took = d }))
+	h(context.Background(), note{}, Metadata{})
+	if took < 10*time.Millisecond {
+		t.Errorf("observed %v for a 10ms handler", took)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var m HandlerMetrics
+	results := []struct {
+		acktype AckType
+		err     error
+	}{
+		{Ack, nil},
+		{Ack, nil},
+		{NackRequeue, nil},
+		{Ack, Retryable(errors.New("busy"))},
+		{Ack, Skip(errors.New("not mine"))},
+		{NackDiscard, nil},
+		{Ack, errors.New("broken")},
+	}
+	for _, r := range results {
+		h := Chain(func(context.Context, note, Metadata) (AckType, error) {
+			if m.Busy.Load() != 1 {
+				t.Errorf("busy = %d while handling", m.Busy.Load())
+			}
+			return r.acktype, r.err
+		}, Metrics[note](&m))
+		h(context.Background(), note{}, Metadata{})
+	}
+
+	var got map[string]int64
+	if err := json.Unmarshal([]byte(m.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["acked"] != 2 || got["requeued"] != 3 || got["discarded"] != 2 || got["busy"] != 0 {
+		t.Errorf("metrics = %v, want 2 acked, 3 requeued and 2 discarded", got)
+	}
+	if got["total_time_ns"] <= 0 {
+		t.Errorf("total time = %d", got["total_time_ns"])
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h := Chain(func(ctx context.Context, _ note, _ Metadata) (AckType, error) {
+		defer wg.Done()
+		<-ctx.Done()
+		// the handler runs on past its deadline until it returns itself
+		<-release
+		return Ack, nil
+	}, Timeout[note](10*time.Millisecond))
+
+	start := time.Now()
+	acktype, err := h(context.Background(), note{}, Metadata{})
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("returned after %v", waited)
+	}
+	if acktype != NackRequeue || ClassOf(err) != ClassRetryable || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("timed out handler = %v, %v; want a retryable timeout", acktype, err)
+	}
+	close(release)
+	wg.Wait()
+
+	h = Chain(func(context.Context, note, Metadata) (AckType, error) {
+		return NackDiscard, nil
+	}, Timeout[note](time.Second))
+	if acktype, err := h(context.Background(), note{}, Metadata{}); acktype != NackDiscard || err != nil {
+		t.Errorf("prompt handler = %v, %v; want its own result", acktype, err)
+	}
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	panicking := func(context.Context, note, Metadata) (AckType, error) {
+		panic("boom")
+	}
+	h := Chain(panicking, Recover[note](), Timeout[note](time.Second))
+	acktype, err := h(context.Background(), note{}, Metadata{})
+	if err == nil || ClassOf(err) != ClassPermanent || !strings.Contains(err.Error(), "handler panicked: boom") {
+		t.Errorf("panicking handler = %v, %v; want a permanent error", acktype, err)
+	}
+
+	// without Recover, the panic reaches the caller's goroutine
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("the panic was lost")
+		} else if p, ok := r.(handlerPanic); !ok || p.value != "boom" || len(p.stack) == 0 {
+			t.Errorf("recovered %v, want the handler's panic and stack", r)
+		}
+	}()
+	Chain(panicking, Timeout[note](time.Second))(context.Background(), note{}, Metadata{})
+}
@@ -0,0 +1,21 @@
+package pubsub
+
+import (
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const ContentTypeMsgpack = "application/msgpack"
+
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (MsgpackCodec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// PooledPublisher spreads publishes over several confirm-mode channels so
+// goroutines publishing at the same time don't queue up behind one channel.
+// It is safe for concurrent use, and publishes are confirmed as with
+// ConfirmingPublisher.
+type PooledPublisher struct {
+	publishers []*ConfirmingPublisher
+	next       atomic.Uint64
+}
+
+// NewPooledPublisher opens up to size channels on broker as they are
+// needed. timeout is how long PublishWithContext waits for a confirm.
+func NewPooledPublisher(broker Broker, size int, timeout time.Duration) *PooledPublisher {
+	p := &PooledPublisher{publishers: make([]*ConfirmingPublisher, max(size, 1))}
+	for i := range p.publishers {
+		p.publishers[i] = NewConfirmingPublisher(broker, timeout)
+	}
+	return p
+}
+
+func (p *PooledPublisher) pick() *ConfirmingPublisher {
+	return p.publishers[p.next.Add(1)%uint64(len(p.publishers))]
+}
+
+func (p *PooledPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return p.pick().PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+func (p *PooledPublisher) PublishDeferred(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*PendingConfirm, error) {
+	return p.pick().PublishDeferred(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// Close closes every channel in the pool. Publishes awaiting a confirm fail
+// with ErrConfirmLost.
+func (p *PooledPublisher) Close() error {
+	var errs []error
+	for _, pub := range p.publishers {
+		errs = append(errs, pub.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// countingChannels is a connection counting the channels opened on it.
+type countingChannels struct {
+	*MemoryConnection
+	opened atomic.Int64
+}
+
+func (c *countingChannels) Channel() (Channel, error) {
+	c.opened.Add(1)
+	return c.MemoryConnection.Channel()
+}
+
+func TestPooledPublisherConcurrent(t *testing.T) {
+	mb := NewMemoryBroker()
+	ch := memChannelOf(t, mb)
+	if _, err := ch.QueueDeclare("moves", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn := &countingChannels{MemoryConnection: mb.Connect()}
+	pool := NewPooledPublisher(conn, 4, time.Second)
+	defer pool.Close()
+
+	const publishers, each = 16, 50
+	var wg sync.WaitGroup
+	for range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range each {
+				if err := pool.PublishWithContext(context.Background(), "", "moves", false, false, amqp.Publishing{}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	q, err := ch.QueueDeclarePassive("moves", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Messages != publishers*each {
+		t.Errorf("moves holds %d messages, want %d", q.Messages, publishers*each)
+	}
+	if opened := conn.opened.Load(); opened != 4 {
+		t.Errorf("opened %d channels, want 4", opened)
+	}
+}
+
+func TestPooledPublisherReplacesBrokenChannels(t *testing.T) {
+	mb := NewMemoryBroker()
+	conn := &countingChannels{MemoryConnection: mb.Connect()}
+	pool := NewPooledPublisher(conn, 2, time.Second)
+	defer pool.Close()
+
+	publish := func(exchange string) error {
+		return pool.PublishWithContext(context.Background(), exchange, "key", false, false, amqp.Publishing{})
+	}
+	for range 2 {
+		if err := publish("amq.direct"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// publishing to a missing exchange closes the channel it was sent on
+	for range 2 {
+		if err := publish("missing"); err == nil {
+			t.Fatal("published to a missing exchange")
+		}
+	}
+	for range 4 {
+		if err := publish("amq.direct"); err != nil {
+			t.Errorf("publishing after the channels broke = %v", err)
+		}
+	}
+	if opened := conn.opened.Load(); opened != 4 {
+		t.Errorf("opened %d channels, want the 2 broken ones replaced", opened)
+	}
+}
@@ -0,0 +1,47 @@
+package pubsub
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const ContentTypeProtobuf = "application/x-protobuf"
+
+// ProtoMarshaler and ProtoUnmarshaler are implemented by types with a
+// hand-written Protocol Buffers encoding.
+type ProtoMarshaler interface {
+	MarshalProto() ([]byte, error)
+}
+
+type ProtoUnmarshaler interface {
+	UnmarshalProto([]byte) error
+}
+
+// ProtobufCodec encodes generated proto.Message types as well as types
+// implementing ProtoMarshaler and ProtoUnmarshaler.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (ProtobufCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case proto.Message:
+		return proto.Marshal(v)
+	case ProtoMarshaler:
+		return v.MarshalProto()
+	}
+	return nil, fmt.Errorf("%T has no protobuf encoding", v)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case proto.Message:
+		return proto.Unmarshal(data, v)
+	case ProtoUnmarshaler:
+		return v.UnmarshalProto(data)
+	}
+	return fmt.Errorf("%T has no protobuf encoding", v)
+}
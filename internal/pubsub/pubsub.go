@@ -1,8 +1,11 @@
 package pubsub
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"sync"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -15,61 +18,412 @@ const (
 	NackDiscard AckType = "nack_discard"
 )
 
+// Subscribe consumes queueName, decoding each delivery with the codec
+// registered for its content type before passing it to handler. Deliveries
+// that can't be decoded are dead-lettered with the reason in a header.
 func Subscribe[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	broker Broker,
 	exchange, queueName, key string,
 	queueType SimpleQueueType,
 	handler func(T) AckType,
-	unmarshal func([]byte) (T, error),
-) error {
-	ch, q, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
-	if err != nil {
-		return err
-	}
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeWithMetadata(ctx, broker, exchange, queueName, key, queueType, func(value T, _ Metadata) AckType {
+		return handler(value)
+	}, opts...)
+}
+
+// SubscribeWithMetadata is Subscribe for handlers that also want the
+// envelope of each message, for example to publish follow-up messages
+// CausedBy it.
+func SubscribeWithMetadata[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange, queueName, key string,
+	queueType SimpleQueueType,
+	handler func(T, Metadata) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeHandler(ctx, broker, exchange, queueName, key, queueType, func(_ context.Context, value T, meta Metadata) (AckType, error) {
+		return handler(value, meta), nil
+	}, opts...)
+}
 
-	if err := ch.Qos(10, 0, false); err != nil {
-		return err
+// SubscribeHandler is Subscribe for a Handler, which middleware set with
+// WithMiddleware wraps. Messages the handler fails with a permanent error
+// are dead-lettered with the error as the reason. The handler's context is
+// cancelled once ctx is done or the subscription is closed.
+func SubscribeHandler[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange, queueName, key string,
+	queueType SimpleQueueType,
+	handler Handler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	options := newSubscribeOptions(opts)
+	for i := len(options.middleware) - 1; i >= 0; i-- {
+		mw, ok := options.middleware[i].(Middleware[T])
+		if !ok {
+			return nil, fmt.Errorf("middleware %T can't wrap a handler of %T", options.middleware[i], *new(T))
+		}
+		handler = mw(handler)
+	}
+	s := &subscriber[T]{
+		broker:    broker,
+		exchange:  exchange,
+		queue:     queueName,
+		key:       key,
+		queueType: queueType,
+		handler:   handler,
+		options:   options,
+		republish: NewConfirmingPublisher(broker, 5*time.Second),
+	}
+	if queueType == Stream {
+		s.offsets = newOffsetTracker()
 	}
-	msgs, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	r, reconnects := broker.(reconnector)
+	var generation uint64
+	if reconnects {
+		generation = r.connectionGeneration()
+	}
+	ch, msgs, tag, err := s.consume()
 	if err != nil {
-		return fmt.Errorf("could not consume messages: %v", err)
-	}
-	go func(subChan *amqp.Channel, msgsChan <-chan amqp.Delivery) {
-		defer subChan.Close()
-		for msg := range msgsChan {
-			value, err := unmarshal(msg.Body)
-			if err != nil {
-				if err := msg.Nack(false, false); err != nil {
-					log.Fatalf("Failed to nack message: %v", err)
-				}
-				continue
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.ctx = ctx
+	sub := &Subscription{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(sub.done)
+		defer s.republish.Close()
+		for {
+			s.consumeUntilDone(ctx, ch, msgs, tag)
+			ch.Close()
+
+			if !reconnects || ctx.Err() != nil {
+				return
 			}
-			acktype := handler(value)
-			switch acktype {
-			case Ack:
-				if err := msg.Ack(false); err != nil {
-					log.Fatalf("Failed to ack message: %v", err)
+			for attempt := 0; ; attempt++ {
+				if !r.awaitReconnect(ctx, generation) {
 					return
 				}
-			case NackRequeue:
-				if err := msg.Nack(false, true); err != nil {
-					log.Fatalf("Failed to nack message: %v", err)
-					return
+				generation = r.connectionGeneration()
+				ch, msgs, tag, err = s.consume()
+				if err == nil {
+					break
 				}
-			case NackDiscard:
-				if err := msg.Nack(false, false); err != nil {
-					log.Fatalf("Failed to nack message: %v", err)
+				s.options.onError(fmt.Errorf("could not resubscribe to %s: %w", queueName, err))
+				if !r.sleep(ctx, DefaultBackoff.Delay(attempt)) {
 					return
 				}
-			default:
-				if err := msg.Nack(false, false); err != nil {
-					log.Fatalf("Failed to nack message: %v", err)
-					return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// reconnector is implemented by brokers that re-establish lost connections.
+type reconnector interface {
+	connectionGeneration() uint64
+	awaitReconnect(ctx context.Context, after uint64) bool
+	sleep(ctx context.Context, d time.Duration) bool
+}
+
+type subscriber[T any] struct {
+	broker    Broker
+	exchange  string
+	queue     string
+	key       string
+	queueType SimpleQueueType
+	handler   Handler[T]
+	// ctx is passed to the handler.
+	ctx       context.Context
+	options   subscribeOptions
+	republish *ConfirmingPublisher
+	// offsets is set for Stream queues.
+	offsets *offsetTracker
+}
+
+func (s *subscriber[T]) consume() (Channel, <-chan amqp.Delivery, string, error) {
+	ch, q, err := DeclareAndBind(s.broker, s.exchange, s.queue, s.key, s.queueType, s.options.queue...)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if err := ch.Qos(s.options.prefetch, 0, false); err != nil {
+		ch.Close()
+		return nil, nil, "", err
+	}
+	var args amqp.Table
+	if s.offsets != nil {
+		offset, err := s.startOffset()
+		if err != nil {
+			ch.Close()
+			return nil, nil, "", err
+		}
+		args = offset.ConsumeArgs()
+	}
+	tag := consumerTag()
+	msgs, err := ch.Consume(q.Name, tag, false, false, false, false, args)
+	if err != nil {
+		ch.Close()
+		return nil, nil, "", fmt.Errorf("could not consume messages: %v", err)
+	}
+	return ch, msgs, tag, nil
+}
+
+// startOffset is where a stream subscription reads from: after the last
+// message it handled, or else after the offset its OffsetStore saved.
+func (s *subscriber[T]) startOffset() (StreamOffset, error) {
+	if last, ok := s.offsets.last(); ok {
+		return Offset(last + 1), nil
+	}
+	if s.options.offsets != nil {
+		last, ok, err := s.options.offsets.Load(s.queue)
+		if err != nil {
+			return StreamOffset{}, fmt.Errorf("could not load offset of %s: %w", s.queue, err)
+		}
+		if ok {
+			return Offset(last + 1), nil
+		}
+	}
+	return s.options.offset, nil
+}
+
+// consumeUntilDone handles deliveries until msgs is closed. Once ctx is done
+// the consumer is cancelled, and deliveries the broker already sent are
+// still handled before returning.
+func (s *subscriber[T]) consumeUntilDone(ctx context.Context, ch Channel, msgs <-chan amqp.Delivery, tag string) {
+	dispatch, wait := s.startWorkers()
+	defer wait()
+
+	stop := ctx.Done()
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			if s.offsets != nil {
+				if offset, ok := tableInt(msg.Headers[HeaderStreamOffset]); ok {
+					s.offsets.dispatched(offset)
 				}
 			}
+			dispatch(msg)
+		case <-stop:
+			stop = nil
+			if err := ch.Cancel(tag, false); err != nil {
+				s.options.onError(fmt.Errorf("could not cancel consumer %s: %w", tag, err))
+				return
+			}
+		}
+	}
+}
+
+// startWorkers starts the subscription's worker pool. dispatch hands a
+// delivery to a worker, and wait stops the pool once its queued deliveries
+// are handled. With key ordering, deliveries sharing a routing key always go
+// to the same worker so they are handled in the order they arrived.
+func (s *subscriber[T]) startWorkers() (dispatch func(amqp.Delivery), wait func()) {
+	if s.options.workers <= 1 {
+		return s.handle, func() {}
+	}
+
+	queues := make([]chan amqp.Delivery, s.options.workers)
+	shared := make(chan amqp.Delivery)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = shared
+		if s.options.orderByKey {
+			queues[i] = make(chan amqp.Delivery, 1)
+		}
+		wg.Add(1)
+		go func(deliveries <-chan amqp.Delivery) {
+			defer wg.Done()
+			for msg := range deliveries {
+				s.handle(msg)
+			}
+		}(queues[i])
+	}
+
+	dispatch = func(msg amqp.Delivery) {
+		if !s.options.orderByKey {
+			shared <- msg
+			return
+		}
+		h := fnv.New32a()
+		h.Write([]byte(msg.RoutingKey))
+		queues[h.Sum32()%uint32(len(queues))] <- msg
+	}
+	wait = func() {
+		if s.options.orderByKey {
+			for _, q := range queues {
+				close(q)
+			}
+		} else {
+			close(shared)
 		}
-	}(ch, msgs)
-	return nil
+		wg.Wait()
+	}
+	return dispatch, wait
+}
+
+func (s *subscriber[T]) handle(msg amqp.Delivery) {
+	if s.offsets != nil {
+		defer s.handledOffset(msg)
+	}
+	restoreRoute(&msg)
+	if s.options.verifier != nil {
+		if err := Verify(msg, s.options.verifier); err != nil {
+			s.deadLetter(msg, ClassPermanent, err.Error())
+			return
+		}
+	}
+	if s.duplicate(msg) {
+		if err := msg.Ack(false); err != nil {
+			s.options.onError(fmt.Errorf("failed to ack duplicate message: %w", err))
+		}
+		return
+	}
+	codec, ok := s.options.codecs.Lookup(msg.ContentType)
+	if !ok {
+		s.deadLetter(msg, ClassPermanent, fmt.Sprintf("unsupported content type %q", msg.ContentType))
+		return
+	}
+	if s.options.encrypted && !IsEncrypted(msg) {
+		s.deadLetter(msg, ClassPermanent, ErrNotEncrypted.Error())
+		return
+	}
+	body, err := Decrypt(msg, s.options.decryptKeys)
+	if err != nil {
+		s.deadLetter(msg, ClassPermanent, err.Error())
+		return
+	}
+	// Decode a decrypted copy so retries and dead letters stay encrypted.
+	plain := msg
+	plain.Body = body
+	value, err := decodeVersioned[T](s.options.schemas, codec, plain)
+	if err != nil {
+		s.deadLetter(msg, ClassPermanent, fmt.Sprintf("could not decode %s payload: %v", codec.ContentType(), err))
+		return
+	}
+	acktype, err := s.handler(s.ctx, value, MetadataOf(msg))
+	if err != nil {
+		s.fail(msg, err)
+		return
+	}
+	switch acktype {
+	case Ack:
+		s.markHandled(msg)
+		if err := msg.Ack(false); err != nil {
+			s.options.onError(fmt.Errorf("failed to ack message: %w", err))
+		}
+	case NackRequeue:
+		if s.options.retry != nil {
+			s.retry(msg, nil)
+			return
+		}
+		if err := msg.Nack(false, true); err != nil {
+			s.options.onError(fmt.Errorf("failed to nack message: %w", err))
+		}
+	case NackDiscard:
+		if err := msg.Nack(false, false); err != nil {
+			s.options.onError(fmt.Errorf("failed to nack message: %w", err))
+		}
+	default:
+		if err := msg.Nack(false, false); err != nil {
+			s.options.onError(fmt.Errorf("failed to nack message: %w", err))
+		}
+	}
+}
+
+// fail settles a message whose handler returned err according to its class.
+func (s *subscriber[T]) fail(msg amqp.Delivery, err error) {
+	switch ClassOf(err) {
+	case ClassRetryable:
+		if s.options.retry != nil {
+			s.retry(msg, err)
+			return
+		}
+		if err := msg.Nack(false, true); err != nil {
+			s.options.onError(fmt.Errorf("failed to nack message: %w", err))
+		}
+	case ClassSkip:
+		if s.options.retry != nil {
+			s.skip(msg, err)
+			return
+		}
+		if err := msg.Nack(false, true); err != nil {
+			s.options.onError(fmt.Errorf("failed to nack message: %w", err))
+		}
+	default:
+		s.deadLetter(msg, ClassPermanent, err.Error())
+	}
+}
+
+// handledOffset records that the stream message msg was settled, saving the
+// subscription's progress to its OffsetStore.
+func (s *subscriber[T]) handledOffset(msg amqp.Delivery) {
+	offset, ok := tableInt(msg.Headers[HeaderStreamOffset])
+	if !ok {
+		return
+	}
+	s.offsets.done(offset, func(last int64) {
+		if s.options.offsets == nil {
+			return
+		}
+		if err := s.options.offsets.Save(s.queue, last); err != nil {
+			s.options.onError(fmt.Errorf("could not save offset of %s: %w", s.queue, err))
+		}
+	})
+}
+
+// duplicate reports whether msg was already handled according to the
+// subscription's dedup store. If the store fails, msg is handled again.
+func (s *subscriber[T]) duplicate(msg amqp.Delivery) bool {
+	if s.options.dedup == nil || msg.MessageId == "" {
+		return false
+	}
+	seen, err := s.options.dedup.Seen(s.queue + "|" + msg.MessageId)
+	if err != nil {
+		s.options.onError(fmt.Errorf("could not check for duplicate of %s: %w", msg.MessageId, err))
+		return false
+	}
+	return seen
+}
+
+func (s *subscriber[T]) markHandled(msg amqp.Delivery) {
+	if s.options.dedup == nil || msg.MessageId == "" {
+		return
+	}
+	if err := s.options.dedup.Mark(s.queue + "|" + msg.MessageId); err != nil {
+		s.options.onError(fmt.Errorf("could not record %s as handled: %w", msg.MessageId, err))
+	}
+}
+
+// deadLetter republishes msg to the dead-letter exchange with reason attached
+// and acks the original. If the republish isn't confirmed, the message is
+// rejected instead so the broker dead-letters it without a reason.
+func (s *subscriber[T]) deadLetter(msg amqp.Delivery, class ErrorClass, reason string) {
+	if err := s.republish.PublishWithContext(
+		context.Background(),
+		DeadLetterExchange,
+		msg.RoutingKey,
+		false,
+		false,
+		deadLetterPublishing(msg, s.queue, class, reason),
+	); err != nil {
+		s.options.onError(fmt.Errorf("could not dead-letter message (%s): %w", reason, err))
+		if err := msg.Nack(false, false); err != nil {
+			s.options.onError(fmt.Errorf("failed to nack message: %w", err))
+		}
+		return
+	}
+	if err := msg.Ack(false); err != nil {
+		s.options.onError(fmt.Errorf("failed to ack message: %w", err))
+	}
 }
 
 type SimpleQueueType string
@@ -77,34 +431,47 @@ type SimpleQueueType string
 const (
 	Durable   SimpleQueueType = "durable"
 	Transient SimpleQueueType = "Transient"
+	// Quorum queues are durable and replicated across the cluster, so they
+	// survive the loss of a node. They can't be exclusive or auto-delete.
+	Quorum SimpleQueueType = "quorum"
+	// Stream queues are durable, replicated append-only logs. They don't
+	// dead-letter, so rejected messages are dropped, and they don't support
+	// TTLs, length limits or single active consumer.
+	Stream SimpleQueueType = "stream"
 )
 
+// topologyRecorder is implemented by brokers that redeclare topology after
+// reconnecting.
+type topologyRecorder interface {
+	recordTopology(t Topology)
+}
+
 func DeclareAndBind(
-	conn *amqp.Connection,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
-) (*amqp.Channel, amqp.Queue, error) {
-	ch, err := conn.Channel()
+	opts ...QueueOption,
+) (Channel, amqp.Queue, error) {
+	ch, err := broker.Channel()
 	if err != nil {
 		return nil, amqp.Queue{}, err
 	}
-	q, err := ch.QueueDeclare(
-		queueName,
-		queueType == Durable,
-		queueType == Transient,
-		queueType == Transient,
-		false,
-		amqp.Table{
-			"x-dead-letter-exchange": "peril_dlx",
-		},
-	)
+	t := Topology{
+		Queues:   []QueueSpec{QueueOf(queueName, queueType, opts...)},
+		Bindings: []BindingSpec{{Queue: queueName, Exchange: exchange, Key: key}},
+	}
+	q, err := t.Queues[0].declare(ch)
+	if err == nil {
+		err = t.Bindings[0].declare(ch)
+	}
 	if err != nil {
+		ch.Close()
 		return nil, amqp.Queue{}, err
 	}
-	if err := ch.QueueBind(queueName, key, exchange, false, nil); err != nil {
-		return nil, amqp.Queue{}, err
+	if r, ok := broker.(topologyRecorder); ok {
+		r.recordTopology(t)
 	}
 	return ch, q, nil
 }
@@ -0,0 +1,41 @@
+// Package pubsubtest provides helpers for testing code that uses the pubsub
+// package.
+package pubsubtest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Channel is the part of a pubsub.Channel Poll reads with.
+type Channel interface {
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Close() error
+}
+
+// Poll waits up to a second for a message to arrive in queue, failing the
+// test if none does. It opens a channel with open for every attempt, as the
+// queue may not exist yet and a failed Get closes its channel.
+func Poll[C Channel](t testing.TB, open func() (C, error), queue string) amqp.Delivery {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		ch, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, ok, err := ch.Get(queue, true)
+		ch.Close()
+		var amqpErr *amqp.Error
+		if err != nil && !(errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound) {
+			t.Fatal(err)
+		}
+		if ok {
+			return msg
+		}
+	}
+	t.Fatalf("nothing arrived in %s", queue)
+	return amqp.Delivery{}
+}
@@ -0,0 +1,105 @@
+package pubsub
+
+import (
+	"fmt"
+	"time"
+)
+
+// QueueOption sets an optional argument of a queue declared with QueueOf.
+type QueueOption func(*QueueSpec)
+
+// Overflow behaviours for WithOverflow.
+const (
+	OverflowDropHead         = "drop-head"
+	OverflowRejectPublish    = "reject-publish"
+	OverflowRejectPublishDLX = "reject-publish-dlx"
+)
+
+func withArg(key string, value any) QueueOption {
+	return func(q *QueueSpec) {
+		if q.Args == nil {
+			q.Args = map[string]any{}
+		}
+		q.Args[key] = value
+	}
+}
+
+// WithMaxLength limits the queue to n ready messages. What happens to the
+// rest is up to WithOverflow, dropping the oldest by default.
+func WithMaxLength(n int64) QueueOption {
+	return withArg("x-max-length", n)
+}
+
+// WithOverflow sets what happens when the queue is at its maximum length:
+// OverflowDropHead, OverflowRejectPublish or OverflowRejectPublishDLX.
+func WithOverflow(mode string) QueueOption {
+	return withArg("x-overflow", mode)
+}
+
+// WithMessageTTL dead-letters messages that have waited in the queue for d.
+func WithMessageTTL(d time.Duration) QueueOption {
+	return withArg("x-message-ttl", d.Milliseconds())
+}
+
+// WithQueueExpiry deletes the queue once it has gone unused for d.
+func WithQueueExpiry(d time.Duration) QueueOption {
+	return withArg("x-expires", d.Milliseconds())
+}
+
+// WithSingleActiveConsumer delivers to one consumer at a time, failing over
+// to the next when it goes away, so messages are handled in order.
+func WithSingleActiveConsumer() QueueOption {
+	return withArg("x-single-active-consumer", true)
+}
+
+// WithMaxAge makes a Stream queue discard messages older than d.
+func WithMaxAge(d time.Duration) QueueOption {
+	return withArg("x-max-age", fmt.Sprintf("%ds", int64(d.Seconds())))
+}
+
+// WithQueueOptions declares the subscription's queue with opts. They must
+// match the queue's existing arguments, or the declaration fails.
+func WithQueueOptions(opts ...QueueOption) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.queue = append(o.queue, opts...)
+	}
+}
+
+// streamUnsupported are the queue arguments stream queues reject.
+var streamUnsupported = []string{
+	"x-dead-letter-exchange",
+	"x-dead-letter-routing-key",
+	"x-message-ttl",
+	"x-expires",
+	"x-max-length",
+	"x-overflow",
+	"x-single-active-consumer",
+}
+
+// Validate reports settings the queue's type doesn't support, which the
+// broker would otherwise reject when the queue is declared.
+func (q QueueSpec) Validate() error {
+	queueType, _ := q.Args["x-queue-type"].(string)
+	switch queueType {
+	case "", "classic":
+		return nil
+	case string(Quorum), string(Stream):
+	default:
+		return fmt.Errorf("queue %s: unknown queue type %q", q.Name, queueType)
+	}
+	if !q.Durable || q.Exclusive || q.AutoDelete {
+		return fmt.Errorf("queue %s: %s queues must be durable, not exclusive or auto-delete", q.Name, queueType)
+	}
+	if queueType == string(Quorum) {
+		if q.Args["x-overflow"] == OverflowRejectPublishDLX {
+			return fmt.Errorf("queue %s: quorum queues don't support overflow %s", q.Name, OverflowRejectPublishDLX)
+		}
+		return nil
+	}
+	for _, arg := range streamUnsupported {
+		if _, ok := q.Args[arg]; ok {
+			return fmt.Errorf("queue %s: stream queues don't support %s", q.Name, arg)
+		}
+	}
+	return nil
+}
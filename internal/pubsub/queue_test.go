@@ -0,0 +1,41 @@
+package pubsub
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueSpecValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		spec QueueSpec
+		want string
+	}{
+		{"classic", QueueOf("moves", Durable, WithMaxLength(10), WithOverflow(OverflowRejectPublishDLX)), ""},
+		{"transient", QueueOf("pause.alice", Transient), ""},
+		{"quorum", QueueOf("moves", Quorum, WithMaxLength(10), WithOverflow(OverflowRejectPublish)), ""},
+		{"stream", QueueOf("game_logs", Stream, WithMaxAge(time.Hour)), ""},
+		{"unknown type", QueueSpec{Name: "moves", Durable: true, Args: map[string]any{"x-queue-type": "lazy"}}, "unknown queue type"},
+		{"transient quorum", QueueSpec{Name: "moves", AutoDelete: true, Args: map[string]any{"x-queue-type": "quorum"}}, "must be durable"},
+		{"exclusive stream", QueueSpec{Name: "logs", Durable: true, Exclusive: true, Args: map[string]any{"x-queue-type": "stream"}}, "must be durable"},
+		{"quorum reject-publish-dlx", QueueOf("moves", Quorum, WithOverflow(OverflowRejectPublishDLX)), "don't support overflow"},
+		{"stream dead-lettering", QueueOf("logs", Stream, WithMessageTTL(time.Minute)), "don't support x-message-ttl"},
+		{"stream max length", QueueOf("logs", Stream, WithMaxLength(10)), "don't support x-max-length"},
+		{"stream single active consumer", QueueOf("logs", Stream, WithSingleActiveConsumer()), "don't support x-single-active-consumer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
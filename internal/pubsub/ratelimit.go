@@ -0,0 +1,177 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Penalty is what happens to a message that exceeds its sender's rate limit.
+type Penalty string
+
+const (
+	// PenaltyDiscard acks the message without handling it.
+	PenaltyDiscard Penalty = "discard"
+	// PenaltyDeadLetter dead-letters the message as a Permanent failure.
+	PenaltyDeadLetter Penalty = "deadletter"
+	// PenaltyMute discards the message and every other message with the
+	// same key until RateLimit.MuteFor has passed.
+	PenaltyMute Penalty = "mute"
+)
+
+func ParsePenalty(s string) (Penalty, error) {
+	switch p := Penalty(s); p {
+	case PenaltyDiscard, PenaltyDeadLetter, PenaltyMute:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown penalty %q", s)
+}
+
+// RateLimit allows Rate messages a second per key, with bursts of up to
+// Burst. A key's bucket is forgotten, along with its counts, once no message
+// has arrived for Idle, or for as long as it takes to refill the bucket and
+// end a mute if that is longer.
+type RateLimit struct {
+	Rate    float64
+	Burst   int
+	Penalty Penalty
+	MuteFor time.Duration
+	Idle    time.Duration
+	// Backlog is how far back send times are believed, and so how old a
+	// backlog can be and still be let through at the rate it was sent. A
+	// sender backdating its messages gains at most Rate×Backlog of them.
+	// Without it messages are limited by when they arrive.
+	Backlog time.Duration
+}
+
+// keep is how long an idle bucket must be kept for forgetting it to make no
+// difference.
+func (r RateLimit) keep() time.Duration {
+	refill := time.Duration(float64(r.Burst) / r.Rate * float64(time.Second))
+	return max(r.Idle, refill, r.MuteFor)
+}
+
+// RateStats counts the messages a RateLimiter has seen for one key.
+type RateStats struct {
+	Key        string
+	Allowed    int64
+	Limited    int64
+	MutedUntil time.Time
+}
+
+// RateLimiter keeps a token bucket for each key it sees. Buckets are filled
+// according to when messages were sent rather than when they arrive, so a
+// backlog built up while nobody was consuming isn't penalised for arriving
+// at once.
+type RateLimiter struct {
+	limit RateLimit
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	// last is the send time of the latest message, and seen when it
+	// arrived.
+	last  time.Time
+	seen  time.Time
+	stats RateStats
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{limit: limit, now: time.Now, buckets: map[string]*bucket{}}
+}
+
+// Allow takes a token from key's bucket for a message sent at sent,
+// reporting false if there was none or key is muted. Send times are taken
+// to be no later than now, no earlier than the limit's Backlog allows and no
+// earlier than the key's previous message.
+func (l *RateLimiter) Allow(key string, sent time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweepLocked(now)
+	if sent.After(now) {
+		sent = now
+	}
+	if floor := now.Add(-l.limit.Backlog); sent.Before(floor) {
+		sent = floor
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: sent, stats: RateStats{Key: key}}
+		l.buckets[key] = b
+	}
+	if sent.Before(b.last) {
+		sent = b.last
+	}
+	b.tokens = min(float64(l.limit.Burst), b.tokens+sent.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last, b.seen = sent, now
+	if sent.Before(b.stats.MutedUntil) {
+		b.stats.Limited++
+		return false
+	}
+	if b.tokens < 1 {
+		b.stats.Limited++
+		if l.limit.Penalty == PenaltyMute {
+			b.stats.MutedUntil = sent.Add(l.limit.MuteFor)
+		}
+		return false
+	}
+	b.tokens--
+	b.stats.Allowed++
+	return true
+}
+
+// sweepLocked forgets the buckets that have been idle long enough, checking
+// at most once per idle period.
+func (l *RateLimiter) sweepLocked(now time.Time) {
+	keep := l.limit.keep()
+	if now.Sub(l.swept) < keep {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if now.Sub(b.seen) >= keep {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Stats reports the counts for every key with a bucket, ordered by key.
+func (l *RateLimiter) Stats() []RateStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make([]RateStats, 0, len(l.buckets))
+	for _, b := range l.buckets {
+		stats = append(stats, b.stats)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
+
+// RateLimited passes messages to the handler only while the key of their
+// metadata is within l's limit, applying its penalty to the rest. The key
+// should be one senders can't pick freely, such as a Sender checked by
+// WithVerifier, or one sender can use up another's limit.
+func RateLimited[T any](l *RateLimiter, key func(Metadata) string) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(ctx context.Context, value T, meta Metadata) (AckType, error) {
+			k := key(meta)
+			if l.Allow(k, meta.Timestamp) {
+				return next(ctx, value, meta)
+			}
+			if l.limit.Penalty == PenaltyDeadLetter {
+				return NackDiscard, Permanent(fmt.Errorf("%s exceeded its rate limit", k))
+			}
+			return Ack, nil
+		}
+	}
+}
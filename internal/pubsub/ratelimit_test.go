@@ -0,0 +1,83 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func fakeClock(l *RateLimiter, now time.Time) *time.Time {
+	l.now = func() time.Time { return now }
+	return &now
+}
+
+func TestRateLimiterKeysOnSender(t *testing.T) {
+	l := NewRateLimiter(RateLimit{Rate: 1, Burst: 2, Penalty: PenaltyMute, MuteFor: time.Hour})
+	var handled []string
+	h := RateLimited[string](l, func(meta Metadata) string { return meta.Sender })(
+		func(_ context.Context, value string, _ Metadata) (AckType, error) {
+			handled = append(handled, value)
+			return Ack, nil
+		})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		h(context.Background(), "spam", Metadata{Sender: "mallory", RoutingKey: "game_logs.victim", Timestamp: now})
+	}
+	h(context.Background(), "real", Metadata{Sender: "victim", RoutingKey: "game_logs.victim", Timestamp: now})
+
+	if len(handled) != 3 || handled[2] != "real" {
+		t.Fatalf("handled %v, want two spam and the victim's log", handled)
+	}
+}
+
+func TestRateLimiterSendTime(t *testing.T) {
+	limit := RateLimit{Rate: 1, Burst: 1, Penalty: PenaltyDiscard, Backlog: time.Hour}
+	tests := []struct {
+		name    string
+		sent    func(now time.Time, i int) time.Time
+		allowed int
+	}{
+		{"backlog sent at the limit", func(now time.Time, i int) time.Time { return now.Add(time.Duration(i-10) * time.Second) }, 10},
+		{"burst sent at once", func(now time.Time, i int) time.Time { return now }, 1},
+		{"sent in the future", func(now time.Time, i int) time.Time { return now.Add(time.Duration(i) * time.Hour) }, 1},
+		{"backdated past the backlog", func(now time.Time, i int) time.Time { return now.Add(time.Duration(i-10) * 100 * time.Hour) }, 1},
+		{"out of order", func(now time.Time, i int) time.Time { return now.Add(time.Duration(-i) * time.Second) }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(limit)
+			now := *fakeClock(l, time.Now())
+			allowed := 0
+			for i := 0; i < 10; i++ {
+				if l.Allow("player", tt.sent(now, i)) {
+					allowed++
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed %d of 10, want %d", allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestRateLimiterForgetsIdleSenders(t *testing.T) {
+	l := NewRateLimiter(RateLimit{Rate: 1, Burst: 1, Penalty: PenaltyMute, MuteFor: time.Minute, Idle: time.Hour})
+	now := fakeClock(l, time.Now())
+	l.Allow("a", *now)
+	l.Allow("a", *now)
+	if stats := l.Stats(); len(stats) != 1 || stats[0].MutedUntil.IsZero() {
+		t.Fatalf("stats = %+v, want a muted", stats)
+	}
+
+	*now = now.Add(30 * time.Minute)
+	l.Allow("b", *now)
+	if stats := l.Stats(); len(stats) != 2 {
+		t.Fatalf("forgot a before it was idle: %+v", stats)
+	}
+
+	*now = now.Add(time.Hour)
+	l.Allow("b", *now)
+	if stats := l.Stats(); len(stats) != 1 || stats[0].Key != "b" {
+		t.Fatalf("stats = %+v, want only b", stats)
+	}
+}
@@ -0,0 +1,276 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrNotConnected = errors.New("not connected to the broker")
+
+// Backoff computes exponentially growing delays between Min and Max.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+var DefaultBackoff = Backoff{Min: 500 * time.Millisecond, Max: 30 * time.Second}
+
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := b.Min
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// ReconnectingBroker is a Broker that redials its underlying connection with
+// backoff whenever it is lost. Topology declared through Topology.Declare or
+// DeclareAndBind is replayed on every new connection, and subscriptions started with Subscribe
+// re-establish their consumers once it is back. It also implements Publisher,
+// publishing on a channel it reopens as needed.
+type ReconnectingBroker struct {
+	dial    func() (Broker, error)
+	backoff Backoff
+
+	mu      sync.Mutex
+	current Broker
+	// generation counts the connections made so far, and connected is
+	// closed when the next one is made.
+	generation uint64
+	connected  chan struct{}
+	topology   Topology
+	notify     []chan *amqp.Error
+	closed     bool
+	done       chan struct{}
+
+	pubMu   sync.Mutex
+	pubConn Broker
+	pubCh   Channel
+}
+
+// DialReconnecting connects to the RabbitMQ server at url and keeps the
+// connection alive until Close is called.
+func DialReconnecting(url string) (*ReconnectingBroker, error) {
+	return NewReconnectingBroker(func() (Broker, error) {
+		return Dial(url)
+	}, DefaultBackoff)
+}
+
+// NewReconnectingBroker makes the first connection with dial, returning its
+// error if it fails, and redials in the background from then on.
+func NewReconnectingBroker(dial func() (Broker, error), backoff Backoff) (*ReconnectingBroker, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	b := &ReconnectingBroker{
+		dial:      dial,
+		backoff:   backoff,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	connected := b.connected
+	go b.run(conn)
+	<-connected
+	return b, nil
+}
+
+func (b *ReconnectingBroker) run(conn Broker) {
+	for {
+		lost := conn.NotifyClose(make(chan *amqp.Error, 1))
+		b.mu.Lock()
+		b.current = conn
+		b.generation++
+		close(b.connected)
+		b.connected = make(chan struct{})
+		b.mu.Unlock()
+
+		select {
+		case err := <-lost:
+			b.mu.Lock()
+			b.current = nil
+			b.mu.Unlock()
+			if err != nil {
+				log.Printf("Lost connection to the broker: %v", err)
+			}
+		case <-b.done:
+			conn.Close()
+			return
+		}
+
+		conn = b.redial()
+		if conn == nil {
+			return
+		}
+		log.Println("Reconnected to the broker")
+	}
+}
+
+// redial dials until a connection succeeds and its topology has been
+// replayed, returning nil if the broker is closed first.
+func (b *ReconnectingBroker) redial() Broker {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(b.backoff.Delay(attempt)):
+		case <-b.done:
+			return nil
+		}
+		conn, err := b.dial()
+		if err != nil {
+			log.Printf("Failed to reconnect to the broker: %v", err)
+			continue
+		}
+		if err := b.replayTopology(conn); err != nil {
+			log.Printf("Failed to redeclare topology: %v", err)
+			conn.Close()
+			continue
+		}
+		return conn
+	}
+}
+
+func (b *ReconnectingBroker) replayTopology(conn Broker) error {
+	b.mu.Lock()
+	topology := b.topology
+	b.mu.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return topology.declare(ch)
+}
+
+// recordTopology remembers declarations to replay after reconnecting.
+func (b *ReconnectingBroker) recordTopology(t Topology) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.topology = b.topology.Merge(t)
+}
+
+// connectionGeneration is the generation of the current connection, or of
+// the last one while reconnecting.
+func (b *ReconnectingBroker) connectionGeneration() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.generation
+}
+
+// awaitReconnect blocks until the broker is connected again after something
+// using connection generation after failed, reporting false if the broker
+// was closed or ctx was cancelled instead. Channels close before the loss of
+// their connection is reported, so unless that connection is still open,
+// this waits for a newer one.
+func (b *ReconnectingBroker) awaitReconnect(ctx context.Context, after uint64) bool {
+	for {
+		b.mu.Lock()
+		conn, generation, connected, closed := b.current, b.generation, b.connected, b.closed
+		b.mu.Unlock()
+		if closed {
+			return false
+		}
+		if conn != nil {
+			if generation > after {
+				return true
+			}
+			if ch, err := conn.Channel(); err == nil {
+				ch.Close()
+				return true
+			}
+		}
+		select {
+		case <-connected:
+		case <-b.done:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (b *ReconnectingBroker) sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-b.done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (b *ReconnectingBroker) Channel() (Channel, error) {
+	b.mu.Lock()
+	conn := b.current
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return nil, amqp.ErrClosed
+	}
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+	return conn.Channel()
+}
+
+func (b *ReconnectingBroker) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+
+	b.mu.Lock()
+	conn := b.current
+	b.mu.Unlock()
+	if b.pubCh != nil && b.pubConn != conn {
+		b.pubCh.Close()
+		b.pubCh = nil
+	}
+	if b.pubCh == nil {
+		ch, err := b.Channel()
+		if err != nil {
+			return err
+		}
+		b.pubConn, b.pubCh = conn, ch
+	}
+	if err := b.pubCh.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg); err != nil {
+		b.pubCh.Close()
+		b.pubCh = nil
+		return err
+	}
+	return nil
+}
+
+func (b *ReconnectingBroker) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(receiver)
+	} else {
+		b.notify = append(b.notify, receiver)
+	}
+	return receiver
+}
+
+func (b *ReconnectingBroker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	b.closed = true
+	close(b.done)
+	for _, receiver := range b.notify {
+		close(receiver)
+	}
+	b.notify = nil
+	b.mu.Unlock()
+	return nil
+}
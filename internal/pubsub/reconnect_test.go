@@ -0,0 +1,188 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// lateNotice is a connection whose loss is reported after its channels have
+// closed, as a real connection's can be.
+type lateNotice struct {
+	*MemoryConnection
+}
+
+func (c lateNotice) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	lost := c.MemoryConnection.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		err, ok := <-lost
+		time.Sleep(20 * time.Millisecond)
+		if ok {
+			receiver <- err
+		}
+		close(receiver)
+	}()
+	return receiver
+}
+
+// reconnecting is a ReconnectingBroker connected to mb, redialling it
+// straight away.
+func reconnecting(t *testing.T, mb *MemoryBroker) *ReconnectingBroker {
+	t.Helper()
+	b, err := NewReconnectingBroker(func() (Broker, error) {
+		return lateNotice{mb.Connect()}, nil
+	}, Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// errorLog collects the errors a subscription reports.
+type errorLog struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *errorLog) report(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs = append(l.errs, err)
+}
+
+func (l *errorLog) reported() []error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]error(nil), l.errs...)
+}
+
+// subscribeNotes subscribes to queue, bound to amq.direct with key, sending
+// what it handles to the returned channel.
+func subscribeNotes(t *testing.T, b Broker, queue, key string, queueType SimpleQueueType, errs *errorLog) <-chan note {
+	t.Helper()
+	handled := make(chan note, 100)
+	sub, err := SubscribeHandler(context.Background(), b, "amq.direct", queue, key, queueType,
+		func(_ context.Context, n note, _ Metadata) (AckType, error) {
+			handled <- n
+			return Ack, nil
+		},
+		WithErrorHandler(errs.report),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sub.Close)
+	return handled
+}
+
+// publishUntilHandled publishes to key until handled receives it, as the
+// queue may not be back yet.
+func publishUntilHandled(t *testing.T, pub Publisher, key string, handled <-chan note) {
+	t.Helper()
+	want := note{Text: key}
+	deadline := time.After(2 * time.Second)
+	for {
+		// publishing fails until the broker is reconnected
+		Publish(pub, "amq.direct", key, ContentTypeJSON, want)
+		select {
+		case got := <-handled:
+			if got != want {
+				t.Errorf("handled %+v, want %+v", got, want)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("nothing published to %s was handled", key)
+		}
+	}
+}
+
+func TestReconnectingBrokerRestart(t *testing.T) {
+	mb := NewMemoryBroker()
+	b := reconnecting(t, mb)
+
+	// transient declarations are lost with the broker, so they must be
+	// replayed
+	err := Topology{
+		Exchanges: []ExchangeSpec{{Name: "events", Kind: amqp.ExchangeTopic}},
+		Queues:    []QueueSpec{{Name: "audit"}},
+		Bindings:  []BindingSpec{{Queue: "audit", Exchange: "events", Key: "#"}},
+	}.Declare(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := &errorLog{}
+	durable := subscribeNotes(t, b, "moves", "move", Durable, errs)
+	transient := subscribeNotes(t, b, "pause.alice", "pause", Transient, errs)
+	publishUntilHandled(t, b, "move", durable)
+	publishUntilHandled(t, b, "pause", transient)
+
+	for restart := 0; restart < 3; restart++ {
+		mb.Restart()
+		publishUntilHandled(t, b, "move", durable)
+		publishUntilHandled(t, b, "pause", transient)
+	}
+
+	ch, err := mb.Connect().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.ExchangeDeclarePassive("events", amqp.ExchangeTopic, false, false, false, false, nil); err != nil {
+		t.Errorf("events exchange wasn't redeclared: %v", err)
+	} else if err := Publish(b, "events", "anything", ContentTypeJSON, note{}); err != nil {
+		t.Fatal(err)
+	} else if msg := mustGet(t, ch, "audit"); msg.Exchange != "events" {
+		t.Errorf("audit received a message from %q", msg.Exchange)
+	}
+	// resubscribing straight after a restart would fail on the lost
+	// connection
+	for _, err := range errs.reported() {
+		t.Errorf("subscription reported %v", err)
+	}
+}
+
+func TestReconnectingBrokerResubscribesWithoutReconnecting(t *testing.T) {
+	mb := NewMemoryBroker()
+	b := reconnecting(t, mb)
+	errs := &errorLog{}
+	handled := subscribeNotes(t, b, "moves", "move", Durable, errs)
+	publishUntilHandled(t, b, "move", handled)
+
+	// the queue is deleted under the consumer, leaving the connection up
+	ch, err := mb.Connect().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDelete("moves", false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	publishUntilHandled(t, b, "move", handled)
+	if generation := b.connectionGeneration(); generation != 1 {
+		t.Errorf("reconnected %d times", generation-1)
+	}
+	for _, err := range errs.reported() {
+		t.Errorf("subscription reported %v", err)
+	}
+}
+
+func TestReconnectingBrokerClose(t *testing.T) {
+	mb := NewMemoryBroker()
+	b := reconnecting(t, mb)
+	closed := b.NotifyClose(make(chan *amqp.Error, 1))
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-closed; ok {
+		t.Error("NotifyClose reported an error for a graceful close")
+	}
+	if _, err := b.Channel(); err != amqp.ErrClosed {
+		t.Errorf("Channel after Close = %v, want ErrClosed", err)
+	}
+	if err := b.Close(); err != amqp.ErrClosed {
+		t.Errorf("second Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,158 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderAttempt counts how many times a message has been delivered to a
+// subscription with a retry policy, starting at 1.
+const HeaderAttempt = "x-peril-attempt"
+
+// HeaderSkips counts how many times a message has been skipped by a
+// subscription with a retry policy.
+const HeaderSkips = "x-peril-skips"
+
+// RetryPolicy replaces NackRequeue's immediate redelivery with delayed
+// retries. A message is held in a retry queue for Backoff.Delay(attempt-1)
+// before returning to its queue, and dead-lettered once MaxAttempts
+// deliveries have been nacked.
+//
+// Skipped messages are held for Backoff.Delay(0) without using up an
+// attempt, and dead-lettered once they have been skipped MaxSkips times, if
+// MaxSkips is set.
+type RetryPolicy struct {
+	MaxAttempts int
+	MaxSkips    int
+	Backoff     Backoff
+}
+
+// WithRetry retries deliveries the handler nacks with NackRequeue, and
+// delays those it skips, according to policy.
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = &policy
+	}
+}
+
+func attemptOf(msg amqp.Delivery) int {
+	if n, ok := tableInt(msg.Headers[HeaderAttempt]); ok && n > 0 {
+		return int(n)
+	}
+	return 1
+}
+
+func skipsOf(msg amqp.Delivery) int {
+	n, _ := tableInt(msg.Headers[HeaderSkips])
+	return int(n)
+}
+
+// retry moves msg to the retry queue for its next attempt, or dead-letters
+// it when its attempts are used up. cause is the handler's error, if any.
+func (s *subscriber[T]) retry(msg amqp.Delivery, cause error) {
+	policy := s.options.retry
+	attempt := attemptOf(msg)
+	if attempt >= policy.MaxAttempts {
+		reason := fmt.Sprintf("gave up after %d attempts", attempt)
+		if cause != nil {
+			reason += ": " + cause.Error()
+		}
+		s.deadLetter(msg, ClassRetryable, reason)
+		return
+	}
+	s.delay(msg, policy.Backoff.Delay(attempt-1), HeaderAttempt, int64(attempt+1))
+}
+
+// skip moves msg to the retry queue for the policy's shortest delay, leaving
+// its attempts alone, or dead-letters it when it has been skipped too often.
+func (s *subscriber[T]) skip(msg amqp.Delivery, cause error) {
+	policy := s.options.retry
+	skips := skipsOf(msg)
+	if policy.MaxSkips > 0 && skips >= policy.MaxSkips {
+		s.deadLetter(msg, ClassSkip, fmt.Sprintf("skipped %d times: %v", skips, cause))
+		return
+	}
+	s.delay(msg, policy.Backoff.Delay(0), HeaderSkips, int64(skips+1))
+}
+
+// delay holds msg in the retry queue for d, setting its counter header to n.
+func (s *subscriber[T]) delay(msg amqp.Delivery, d time.Duration, counter string, n int64) {
+	retryQueue, err := s.declareRetryQueue(d)
+	if err == nil {
+		pub := deliveryPublishing(msg)
+		pub.Headers[counter] = n
+		pub.Headers[HeaderOriginalExchange] = msg.Exchange
+		pub.Headers[HeaderOriginalRoutingKey] = msg.RoutingKey
+		err = s.republish.PublishWithContext(context.Background(), "", retryQueue, false, false, pub)
+	}
+	if err != nil {
+		s.options.onError(fmt.Errorf("could not schedule retry, requeueing: %w", err))
+		if err := msg.Nack(false, true); err != nil {
+			s.options.onError(fmt.Errorf("failed to nack message: %w", err))
+		}
+		return
+	}
+	if err := msg.Ack(false); err != nil {
+		s.options.onError(fmt.Errorf("failed to ack message: %w", err))
+	}
+}
+
+// declareRetryQueue declares the queue holding messages for delay. Expired
+// messages are dead-lettered through the default exchange straight back to
+// the subscription's queue.
+func (s *subscriber[T]) declareRetryQueue(delay time.Duration) (string, error) {
+	name := retryQueueName(s.queue, delay)
+	args := amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": s.queue,
+	}
+	if s.queueType == Transient {
+		args["x-expires"] = (delay + time.Minute).Milliseconds()
+	}
+
+	ch, err := s.broker.Channel()
+	if err != nil {
+		return "", err
+	}
+	defer ch.Close()
+	if _, err := ch.QueueDeclare(name, s.queueType != Transient, false, false, false, args); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", queue, delay.Milliseconds())
+}
+
+// Queues names the retry queues a subscription to queue with the policy
+// may hold messages in.
+func (p RetryPolicy) Queues(queue string) []string {
+	var names []string
+	for attempt := 1; attempt <= max(p.MaxAttempts-1, 1); attempt++ {
+		name := retryQueueName(queue, p.Backoff.Delay(attempt-1))
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// restoreRoute puts back the exchange and routing key of a message that
+// returned from a retry queue through the default exchange.
+func restoreRoute(msg *amqp.Delivery) {
+	if msg.Exchange != "" {
+		return
+	}
+	if exchange, ok := msg.Headers[HeaderOriginalExchange].(string); ok {
+		msg.Exchange = exchange
+	}
+	if key, ok := msg.Headers[HeaderOriginalRoutingKey].(string); ok {
+		msg.RoutingKey = key
+	}
+}
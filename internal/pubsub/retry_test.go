@@ -0,0 +1,62 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/pubsubtest"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	conn := NewMemoryBroker().Connect()
+	if err := DeadLetterTopology("dead").Declare(conn); err != nil {
+		t.Fatal(err)
+	}
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: Backoff{Min: 20 * time.Millisecond, Max: 40 * time.Millisecond}}
+	delivered := make(chan time.Time, 10)
+	sub, err := SubscribeHandler(context.Background(), conn, "amq.direct", "notes", "note", Durable,
+		func(context.Context, note, Metadata) (AckType, error) {
+			delivered <- time.Now()
+			return Ack, Retryable(errors.New("boom"))
+		},
+		WithRetry(policy),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if err := Publish(memChannelOf(t, conn.broker), "amq.direct", "note", ContentTypeJSON, note{Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dead := pubsubtest.Poll(t, conn.Channel, "dead")
+	if dead.Headers[HeaderErrorClass] != string(ClassRetryable) {
+		t.Errorf("dead-lettered as %v", dead.Headers[HeaderErrorClass])
+	}
+	if reason := dead.Headers[HeaderDeadLetterReason]; reason != "gave up after 3 attempts: boom" {
+		t.Errorf("dead-lettered because %v", reason)
+	}
+	if attempt, _ := tableInt(dead.Headers[HeaderAttempt]); attempt != 3 {
+		t.Errorf("%s = %d, want 3", HeaderAttempt, attempt)
+	}
+
+	close(delivered)
+	var times []time.Time
+	for at := range delivered {
+		times = append(times, at)
+	}
+	if len(times) != policy.MaxAttempts {
+		t.Fatalf("delivered %d times, want %d", len(times), policy.MaxAttempts)
+	}
+	for attempt := 1; attempt < len(times); attempt++ {
+		if waited, want := times[attempt].Sub(times[attempt-1]), policy.Backoff.Delay(attempt-1); waited < want {
+			t.Errorf("attempt %d came %v after the last, want at least %v", attempt+1, waited, want)
+		}
+	}
+	if got, want := policy.Queues("notes"), []string{"notes.retry.20", "notes.retry.40"}; !slices.Equal(got, want) {
+		t.Errorf("Queues = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,138 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DirectReplyTo is RabbitMQ's pseudo-queue for receiving replies without
+// declaring a reply queue.
+const DirectReplyTo = "amq.rabbitmq.reply-to"
+
+// HeaderRPCError carries the error a Serve handler returned in place of a
+// response.
+const HeaderRPCError = "x-peril-rpc-error"
+
+var ErrNoReply = errors.New("channel closed before a reply arrived")
+
+// RemoteError is an error returned by the handler that served a Call.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
+
+// Call sends req as JSON to exchange with key and waits for the reply,
+// which arrives on DirectReplyTo. ctx bounds how long it waits. If the
+// handler failed, the error is a *RemoteError. A request sent Mandatory()
+// that no queue receives fails with a *ReturnedError straight away. If ctx
+// has a deadline, the request expires from the queue once it passes, so a
+// server that was down doesn't answer Calls nobody is waiting for.
+func Call[Req, Resp any](ctx context.Context, broker Broker, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+	msg, err := newPublishing(ContentTypeJSON, req, opts)
+	if err != nil {
+		return resp, err
+	}
+	msg.ReplyTo = DirectReplyTo
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Expiration = strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10)
+	}
+
+	ch, err := broker.Channel()
+	if err != nil {
+		return resp, err
+	}
+	defer ch.Close()
+	// The reply consumer must exist before the request is published.
+	replies, err := ch.Consume(DirectReplyTo, consumerTag(), true, false, false, false, nil)
+	if err != nil {
+		return resp, fmt.Errorf("could not consume replies: %w", err)
+	}
+	var returns chan amqp.Return
+	if r, ok := ch.(returner); ok && msg.mandatory {
+		returns = r.NotifyReturn(make(chan amqp.Return, 1))
+	}
+	if err := ch.PublishWithContext(ctx, exchange, key, msg.mandatory, false, msg.Publishing); err != nil {
+		return resp, err
+	}
+
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				return resp, ErrNoReply
+			}
+			if meta := MetadataOf(reply); meta.CausationID != msg.MessageId {
+				continue
+			}
+			if remote, ok := reply.Headers[HeaderRPCError].(string); ok {
+				return resp, &RemoteError{Message: remote}
+			}
+			codec, ok := DefaultCodecs.Lookup(reply.ContentType)
+			if !ok {
+				return resp, fmt.Errorf("unsupported reply content type %q", reply.ContentType)
+			}
+			return decodeVersioned[Resp](DefaultSchemas, codec, reply)
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			if ret.MessageId == msg.MessageId {
+				return resp, &ReturnedError{Exchange: ret.Exchange, RoutingKey: ret.RoutingKey, ReplyCode: ret.ReplyCode, ReplyText: ret.ReplyText}
+			}
+		case <-ctx.Done():
+			return resp, fmt.Errorf("no reply to %s: %w", key, ctx.Err())
+		}
+	}
+}
+
+// Serve answers Calls sent to exchange with key, consuming them from
+// queueName. The handler's response, or its error, is sent back with the
+// request's content type.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	broker Broker,
+	exchange, queueName, key string,
+	queueType SimpleQueueType,
+	handler func(Req) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	onError := newSubscribeOptions(opts).onError
+	replies := NewConfirmingPublisher(broker, 5*time.Second)
+	sub, err := SubscribeWithMetadata(ctx, broker, exchange, queueName, key, queueType, func(req Req, meta Metadata) AckType {
+		if meta.ReplyTo == "" {
+			return NackDiscard
+		}
+		resp, err := handler(req)
+		var msg publishing
+		if err == nil {
+			msg, err = newPublishing(meta.ContentType, resp, []PublishOption{CausedBy(meta)})
+		}
+		if err != nil {
+			msg = envelope(resp, []PublishOption{CausedBy(meta)})
+			msg.Headers[HeaderRPCError] = err.Error()
+		}
+		if err := replies.PublishWithContext(context.Background(), "", meta.ReplyTo, false, false, msg.Publishing); err != nil {
+			onError(fmt.Errorf("could not reply to %s: %w", meta.MessageID, err))
+		}
+		return Ack
+	}, opts...)
+	if err != nil {
+		replies.Close()
+		return nil, err
+	}
+	go func() {
+		sub.Wait()
+		replies.Close()
+	}()
+	return sub, nil
+}
@@ -0,0 +1,106 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func serveNotes(t *testing.T, b Broker, handler func(note) (note, error)) {
+	t.Helper()
+	sub, err := Serve(context.Background(), b, "amq.direct", "shout", "shout", Durable, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sub.Close)
+}
+
+func callShout(b Broker, text string, timeout time.Duration) (note, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return Call[note, note](ctx, b, "amq.direct", "shout", note{Text: text})
+}
+
+func TestCall(t *testing.T) {
+	conn := NewMemoryBroker().Connect()
+	serveNotes(t, conn, func(n note) (note, error) {
+		if n.Text == "" {
+			return note{}, errors.New("nothing to shout")
+		}
+		return note{Text: strings.ToUpper(n.Text)}, nil
+	})
+
+	got, err := callShout(conn, "hello", time.Second)
+	if err != nil || got.Text != "HELLO" {
+		t.Errorf("Call = %+v, %v; want HELLO", got, err)
+	}
+	_, err = callShout(conn, "", time.Second)
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Message != "nothing to shout" {
+		t.Errorf("Call = %v, want the handler's error", err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	mb := NewMemoryBroker()
+	ch := memChannelOf(t, mb)
+	// the queue exists, but nothing serves it
+	if _, err := ch.QueueDeclare("shout", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("shout", "shout", "amq.direct", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := callShout(mb.Connect(), "hello", 20*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Call = %v, want DeadlineExceeded", err)
+	}
+	// a server starting late mustn't answer it
+	time.Sleep(20 * time.Millisecond)
+	if _, ok, _ := ch.Get("shout", false); ok {
+		t.Error("the request outlived the call")
+	}
+}
+
+func TestCallDropsStaleReplies(t *testing.T) {
+	mb := NewMemoryBroker()
+	ch := memChannelOf(t, mb)
+	if _, err := ch.QueueDeclare("shout", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("shout", "shout", "amq.direct", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	requests, err := ch.Consume("shout", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for req := range requests {
+			// a reply to an earlier request arrives first
+			stale, err := newPublishing(ContentTypeJSON, note{Text: "STALE"}, []PublishOption{CausedBy(Metadata{MessageID: NewMessageID()})})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			reply, err := newPublishing(ContentTypeJSON, note{Text: "HELLO"}, []PublishOption{CausedBy(MetadataOf(req))})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, msg := range []amqp.Publishing{stale.Publishing, reply.Publishing} {
+				if err := ch.PublishWithContext(context.Background(), "", req.ReplyTo, false, false, msg); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+
+	got, err := callShout(mb.Connect(), "hello", time.Second)
+	if err != nil || got.Text != "HELLO" {
+		t.Errorf("Call = %+v, %v; want the reply to this call", got, err)
+	}
+}
@@ -0,0 +1,164 @@
+package pubsub
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderSchemaVersion is the schema version of a message's payload.
+// Messages without it are version 1.
+const HeaderSchemaVersion = "x-peril-schema-version"
+
+// SchemaRegistry knows the current schema version of message types and how
+// to upcast payloads of older versions to it.
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	schemas map[reflect.Type]*schema
+}
+
+type schema struct {
+	version   int
+	upcasters map[int]Upcaster
+}
+
+// Upcaster converts a payload from one schema version to the next.
+type Upcaster struct {
+	from    int
+	decode  func(codec Codec, data []byte) (any, error)
+	convert func(v any) (any, error)
+}
+
+// Upcast converts version from payloads, decoded as From, to the From type
+// of version from+1, or to the current type if that is the latest version.
+// Older versions keep their own Go types so any codec can decode them.
+func Upcast[From, To any](from int, fn func(From) (To, error)) Upcaster {
+	return Upcaster{
+		from: from,
+		decode: func(codec Codec, data []byte) (any, error) {
+			var v From
+			if err := codec.Unmarshal(data, &v); err != nil {
+				return nil, err
+			}
+			return v, nil
+		},
+		convert: func(v any) (any, error) {
+			old, ok := v.(From)
+			if !ok {
+				return nil, fmt.Errorf("upcaster from version %d expects %T, got %T", from, old, v)
+			}
+			return fn(old)
+		},
+	}
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{schemas: map[reflect.Type]*schema{}}
+}
+
+// DefaultSchemas is used by Publish and by subscriptions that don't set
+// WithSchemas.
+var DefaultSchemas = NewSchemaRegistry()
+
+// RegisterSchema sets the current schema version of T, with upcasters
+// covering every older version that may still be in flight.
+func RegisterSchema[T any](r *SchemaRegistry, version int, upcasters ...Upcaster) {
+	s := &schema{version: version, upcasters: map[int]Upcaster{}}
+	for _, u := range upcasters {
+		if u.from >= version {
+			panic(fmt.Sprintf("pubsub: upcaster from version %d of %v is not older than version %d", u.from, reflect.TypeFor[T](), version))
+		}
+		s.upcasters[u.from] = u
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas[reflect.TypeFor[T]()] = s
+}
+
+// Version reports the current schema version of values of type t, which is
+// 1 unless registered otherwise.
+func (r *SchemaRegistry) Version(t reflect.Type) int {
+	if s := r.lookup(t); s != nil {
+		return s.version
+	}
+	return 1
+}
+
+func (r *SchemaRegistry) lookup(t reflect.Type) *schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.schemas[t]
+}
+
+func schemaVersionOf(msg amqp.Delivery) int {
+	if n, ok := tableInt(msg.Headers[HeaderSchemaVersion]); ok && n > 0 {
+		return int(n)
+	}
+	return 1
+}
+
+// decodeVersioned decodes msg into T, decompressing it and upcasting it
+// first if it was published with an older schema version.
+func decodeVersioned[T any](r *SchemaRegistry, codec Codec, msg amqp.Delivery) (T, error) {
+	var value T
+	body, err := Decompress(msg)
+	if err != nil {
+		return value, err
+	}
+	msg.Body = body
+	current, version := 1, schemaVersionOf(msg)
+	s := r.lookup(reflect.TypeFor[T]())
+	if s != nil {
+		current = s.version
+	}
+	if version > current {
+		return value, fmt.Errorf("schema version %d is newer than supported version %d", version, current)
+	}
+	if version == current {
+		err := codec.Unmarshal(msg.Body, &value)
+		return value, err
+	}
+
+	u, ok := s.upcasters[version]
+	if !ok {
+		return value, fmt.Errorf("no upcaster from schema version %d to %d", version, current)
+	}
+	v, err := u.decode(codec, msg.Body)
+	if err != nil {
+		return value, err
+	}
+	for ; version < current; version++ {
+		u, ok := s.upcasters[version]
+		if !ok {
+			return value, fmt.Errorf("no upcaster from schema version %d to %d", version, current)
+		}
+		if v, err = u.convert(v); err != nil {
+			return value, fmt.Errorf("could not upcast from schema version %d: %w", version, err)
+		}
+	}
+	value, ok = v.(T)
+	if !ok {
+		return value, fmt.Errorf("upcasting to schema version %d produced %T, not %T", current, v, value)
+	}
+	return value, nil
+}
+
+// Decode decodes a delivery into T with DefaultCodecs, upcasting it with
+// DefaultSchemas, as a subscription would.
+func Decode[T any](msg amqp.Delivery) (T, error) {
+	codec, ok := DefaultCodecs.Lookup(msg.ContentType)
+	if !ok {
+		var value T
+		return value, fmt.Errorf("unsupported content type %q", msg.ContentType)
+	}
+	return decodeVersioned[T](DefaultSchemas, codec, msg)
+}
+
+// WithSchemas upcasts deliveries using schemas instead of DefaultSchemas.
+func WithSchemas(schemas *SchemaRegistry) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.schemas = schemas
+	}
+}
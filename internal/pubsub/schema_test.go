@@ -0,0 +1,210 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Version 1 of the score fixture named the player Username. Version 2
+// renamed it and recorded where the score came from.
+type scoreV1 struct {
+	Username string
+	Points   int
+}
+
+type scoreV2 struct {
+	Player string
+	Points int
+	Source string
+}
+
+// Version 3 keeps points as a float.
+type scoreV3 struct {
+	Player string
+	Points float64
+	Source string
+}
+
+func upcastScoreV1(old scoreV1) (scoreV2, error) {
+	if old.Points < 0 {
+		return scoreV2{}, errors.New("negative score")
+	}
+	return scoreV2{Player: old.Username, Points: old.Points, Source: "v1"}, nil
+}
+
+func upcastScoreV2(old scoreV2) (scoreV3, error) {
+	return scoreV3{Player: old.Player, Points: float64(old.Points), Source: old.Source}, nil
+}
+
+// versioned is a delivery of value encoded with codec and labelled with
+// version, or with no version header if it is 0.
+func versioned(t *testing.T, codec Codec, value any, version int) amqp.Delivery {
+	t.Helper()
+	body, err := codec.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := amqp.Delivery{ContentType: codec.ContentType(), Body: body, Headers: amqp.Table{}}
+	if version > 0 {
+		msg.Headers[HeaderSchemaVersion] = int64(version)
+	}
+	return msg
+}
+
+func TestDecodeUpcastsOlderVersions(t *testing.T) {
+	schemas := NewSchemaRegistry()
+	RegisterSchema[scoreV2](schemas, 2, Upcast(1, upcastScoreV1))
+	want := scoreV2{Player: "alice", Points: 3, Source: "v1"}
+
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}, MsgpackCodec{}} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			for _, version := range []int{0, 1} {
+				got, err := decodeVersioned[scoreV2](schemas, codec, versioned(t, codec, scoreV1{Username: "alice", Points: 3}, version))
+				if err != nil {
+					t.Fatalf("version %d: %v", version, err)
+				}
+				if got != want {
+					t.Errorf("version %d decoded as %+v, want %+v", version, got, want)
+				}
+			}
+
+			current := scoreV2{Player: "bob", Points: 5, Source: "live"}
+			got, err := decodeVersioned[scoreV2](schemas, codec, versioned(t, codec, current, 2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != current {
+				t.Errorf("current version decoded as %+v, want %+v", got, current)
+			}
+		})
+	}
+}
+
+func TestDecodeUpcastsThroughEveryVersion(t *testing.T) {
+	schemas := NewSchemaRegistry()
+	RegisterSchema[scoreV3](schemas, 3, Upcast(1, upcastScoreV1), Upcast(2, upcastScoreV2))
+
+	got, err := decodeVersioned[scoreV3](schemas, JSONCodec{}, versioned(t, JSONCodec{}, scoreV1{Username: "alice", Points: 3}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (scoreV3{Player: "alice", Points: 3, Source: "v1"}); got != want {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func decodeAs[T any](r *SchemaRegistry, msg amqp.Delivery) error {
+	_, err := decodeVersioned[T](r, JSONCodec{}, msg)
+	return err
+}
+
+func TestDecodeVersionErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		schemas func(*SchemaRegistry)
+		decode  func(*SchemaRegistry, amqp.Delivery) error
+		value   any
+		version int
+		want    string
+	}{
+		{
+			name:    "newer than supported",
+			schemas: func(r *SchemaRegistry) { RegisterSchema[scoreV2](r, 2, Upcast(1, upcastScoreV1)) },
+			decode:  decodeAs[scoreV2],
+			value:   scoreV2{Player: "alice"},
+			version: 3,
+			want:    "schema version 3 is newer than supported version 2",
+		},
+		{
+			name:    "newer than an unregistered type",
+			schemas: func(*SchemaRegistry) {},
+			decode:  decodeAs[scoreV2],
+			value:   scoreV2{Player: "alice"},
+			version: 2,
+			want:    "schema version 2 is newer than supported version 1",
+		},
+		{
+			name:    "missing upcaster",
+			schemas: func(r *SchemaRegistry) { RegisterSchema[scoreV2](r, 2) },
+			decode:  decodeAs[scoreV2],
+			value:   scoreV1{Username: "alice"},
+			version: 1,
+			want:    "no upcaster from schema version 1 to 2",
+		},
+		{
+			name:    "missing upcaster in the chain",
+			schemas: func(r *SchemaRegistry) { RegisterSchema[scoreV3](r, 3, Upcast(1, upcastScoreV1)) },
+			decode:  decodeAs[scoreV3],
+			value:   scoreV1{Username: "alice"},
+			version: 1,
+			want:    "no upcaster from schema version 2 to 3",
+		},
+		{
+			name:    "upcaster fails",
+			schemas: func(r *SchemaRegistry) { RegisterSchema[scoreV2](r, 2, Upcast(1, upcastScoreV1)) },
+			decode:  decodeAs[scoreV2],
+			value:   scoreV1{Username: "alice", Points: -1},
+			version: 1,
+			want:    "could not upcast from schema version 1: negative score",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schemas := NewSchemaRegistry()
+			tt.schemas(schemas)
+			msg := versioned(t, JSONCodec{}, tt.value, tt.version)
+			if err := tt.decode(schemas, msg); err == nil || err.Error() != tt.want {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterSchemaRejectsNewerUpcaster(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering an upcaster from the current version didn't panic")
+		}
+	}()
+	RegisterSchema[scoreV2](NewSchemaRegistry(), 2, Upcast(2, upcastScoreV2))
+}
+
+func TestSubscriptionUpcasts(t *testing.T) {
+	schemas := NewSchemaRegistry()
+	RegisterSchema[scoreV2](schemas, 2, Upcast(1, upcastScoreV1))
+	conn := NewMemoryBroker().Connect()
+
+	got := make(chan scoreV2, 1)
+	sub, err := SubscribeHandler(context.Background(), conn, "amq.direct", "scores", "score", Durable,
+		func(_ context.Context, score scoreV2, _ Metadata) (AckType, error) {
+			got <- score
+			return Ack, nil
+		},
+		WithSchemas(schemas),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// an older client publishing the type it knows as version 1
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Publish(ch, "amq.direct", "score", ContentTypeJSON, scoreV1{Username: "alice", Points: 3}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case score := <-got:
+		if want := (scoreV2{Player: "alice", Points: 3, Source: "v1"}); score != want {
+			t.Errorf("handled %+v, want %+v", score, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the version 1 message wasn't handled")
+	}
+}
@@ -0,0 +1,259 @@
+package pubsub
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderSignature carries the Ed25519 signature of a message by its sender,
+// and HeaderCertificate the Certificate for the key that made it.
+const (
+	HeaderSignature   = "x-peril-signature"
+	HeaderCertificate = "x-peril-certificate"
+)
+
+var (
+	ErrUnsigned       = errors.New("message is not signed")
+	ErrBadSignature   = errors.New("message signature does not match its sender's key")
+	ErrBadCertificate = errors.New("sender's certificate was not issued by the trusted issuer")
+	ErrSenderTaken    = errors.New("sender is registered with another key")
+)
+
+// Certificate binds a sender to the public key it signs messages with. It
+// is signed by a KeyIssuer, so anyone who trusts the issuer can check that a
+// message came from its sender without being able to sign as them. This is
+// why messages are signed with Ed25519 rather than HMAC: with HMAC, whoever
+// can check a sender's messages holds the key to forge them, so only the
+// server could verify.
+//
+// Certificates don't expire. One stays valid for as long as its issuer's key
+// is trusted.
+type Certificate struct {
+	Sender    string
+	PublicKey ed25519.PublicKey
+	Signature []byte
+}
+
+func (c Certificate) signed() []byte {
+	return appendFields([]byte("peril certificate\x00"), c.Sender, string(c.PublicKey))
+}
+
+// Verify checks that issuer signed c.
+func (c Certificate) Verify(issuer ed25519.PublicKey) error {
+	if len(issuer) != ed25519.PublicKeySize || len(c.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: malformed key", ErrBadCertificate)
+	}
+	if !ed25519.Verify(issuer, c.signed(), c.Signature) {
+		return ErrBadCertificate
+	}
+	return nil
+}
+
+func (c Certificate) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func parseCertificate(s string) (Certificate, error) {
+	var c Certificate
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	return c, json.Unmarshal(data, &c)
+}
+
+// SignedBy records cert's sender as the message's sender, like WithSender,
+// and signs the message with key, the private half of cert's public key. The
+// signature covers the body as sent, the sender and the message's identity,
+// but not its route, so it survives retries and requeues.
+func SignedBy(key ed25519.PrivateKey, cert Certificate) PublishOption {
+	return func(p *publishing) {
+		p.Headers[HeaderSender] = cert.Sender
+		p.Headers[HeaderCertificate] = cert.encode()
+		p.signKey = key
+	}
+}
+
+// sign adds the signature SignedBy asked for. It must run after the body is
+// final.
+func (p *publishing) sign() {
+	if p.signKey == nil {
+		return
+	}
+	sender, _ := p.Headers[HeaderSender].(string)
+	sig := ed25519.Sign(p.signKey, signedContent(sender, p.Publishing))
+	p.Headers[HeaderSignature] = base64.StdEncoding.EncodeToString(sig)
+}
+
+func signedContent(sender string, msg amqp.Publishing) []byte {
+	return appendFields([]byte("peril message\x00"),
+		sender,
+		msg.MessageId,
+		strconv.FormatInt(msg.Timestamp.Unix(), 10),
+		msg.Type,
+		msg.ContentType,
+		msg.ContentEncoding,
+		string(msg.Body),
+	)
+}
+
+// appendFields appends each field length-prefixed, so fields can't bleed
+// into one another.
+func appendFields(data []byte, fields ...string) []byte {
+	for _, field := range fields {
+		data = strconv.AppendInt(data, int64(len(field)), 10)
+		data = append(data, ':')
+		data = append(data, field...)
+	}
+	return data
+}
+
+// Verify checks that msg was signed by its sender, with a key certified by
+// issuer.
+func Verify(msg amqp.Delivery, issuer ed25519.PublicKey) error {
+	sig, ok := msg.Headers[HeaderSignature].(string)
+	encoded, hasCert := msg.Headers[HeaderCertificate].(string)
+	if !ok || !hasCert {
+		return ErrUnsigned
+	}
+	cert, err := parseCertificate(encoded)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadCertificate, err)
+	}
+	if err := cert.Verify(issuer); err != nil {
+		return err
+	}
+	sender, _ := msg.Headers[HeaderSender].(string)
+	if cert.Sender != sender {
+		return fmt.Errorf("%w: certificate is for %q, not %q", ErrBadCertificate, cert.Sender, sender)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || !ed25519.Verify(cert.PublicKey, signedContent(sender, deliveryPublishing(msg)), raw) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// WithVerifier dead-letters deliveries that aren't signed by their sender
+// with a key certified by issuer.
+func WithVerifier(issuer ed25519.PublicKey) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.verifier = issuer
+	}
+}
+
+// OpenIdentity reads the private key kept in path, generating it the first
+// time.
+func OpenIdentity(path string) (ed25519.PrivateKey, error) {
+	seed, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, key.Seed(), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s does not hold an Ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// KeyIssuer certifies the keys senders sign with. The first key a sender is
+// certified with stays theirs: the registry is kept in a file, so restarting
+// the issuer doesn't free the name up, and a sender coming back with the
+// same key is certified again.
+//
+// Keys can't be rotated or revoked. A sender who loses their key can't get
+// another certified under the same name, and a stolen key signs as its
+// sender until the issuer's own key is replaced, invalidating every
+// certificate. Removing a sender from the registry file frees the name but
+// doesn't revoke certificates already issued.
+type KeyIssuer struct {
+	key  ed25519.PrivateKey
+	path string
+
+	mu   sync.Mutex
+	keys map[string]ed25519.PublicKey
+}
+
+// OpenKeyIssuer signs with the identity in keyPath and keeps its registry in
+// registryPath, creating both the first time.
+func OpenKeyIssuer(keyPath, registryPath string) (*KeyIssuer, error) {
+	key, err := OpenIdentity(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	k := &KeyIssuer{key: key, path: registryPath, keys: map[string]ed25519.PublicKey{}}
+	data, err := os.ReadFile(registryPath)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &k.keys); err != nil {
+		return nil, fmt.Errorf("could not read registered keys from %s: %w", registryPath, err)
+	}
+	return k, nil
+}
+
+// PublicKey is the key certificates are checked with.
+func (k *KeyIssuer) PublicKey() ed25519.PublicKey {
+	return k.key.Public().(ed25519.PublicKey)
+}
+
+// Issue certifies that sender signs with key, registering it if sender is
+// new. It fails with ErrSenderTaken if sender registered another key.
+func (k *KeyIssuer) Issue(sender string, key ed25519.PublicKey) (Certificate, error) {
+	if sender == "" {
+		return Certificate{}, errors.New("no sender")
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return Certificate{}, errors.New("malformed public key")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if registered, ok := k.keys[sender]; ok {
+		if !registered.Equal(key) {
+			return Certificate{}, ErrSenderTaken
+		}
+	} else {
+		k.keys[sender] = key
+		if err := k.saveLocked(); err != nil {
+			delete(k.keys, sender)
+			return Certificate{}, fmt.Errorf("could not register %s: %w", sender, err)
+		}
+	}
+	cert := Certificate{Sender: sender, PublicKey: key}
+	cert.Signature = ed25519.Sign(k.key, cert.signed())
+	return cert, nil
+}
+
+func (k *KeyIssuer) saveLocked() error {
+	data, err := json.Marshal(k.keys)
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
@@ -0,0 +1,103 @@
+package pubsub
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func openTestIssuer(t *testing.T, dir string) *KeyIssuer {
+	t.Helper()
+	issuer, err := OpenKeyIssuer(filepath.Join(dir, "issuer.key"), filepath.Join(dir, "players.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func TestKeyIssuerIssue(t *testing.T) {
+	dir := t.TempDir()
+	issuer := openTestIssuer(t, dir)
+	alice, mallory := newTestKey(t), newTestKey(t)
+	alicePublic := alice.Public().(ed25519.PublicKey)
+
+	cert, err := issuer.Issue("alice", alicePublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Verify(issuer.PublicKey()); err != nil || cert.Sender != "alice" || !cert.PublicKey.Equal(alicePublic) {
+		t.Errorf("issued %+v, verifying: %v", cert, err)
+	}
+	if _, err := issuer.Issue("alice", alicePublic); err != nil {
+		t.Errorf("alice coming back with her key: %v", err)
+	}
+	if _, err := issuer.Issue("alice", mallory.Public().(ed25519.PublicKey)); err != ErrSenderTaken {
+		t.Errorf("certifying another key for alice = %v, want ErrSenderTaken", err)
+	}
+	if _, err := issuer.Issue("", alicePublic); err == nil {
+		t.Error("certified a key for no sender")
+	}
+	if _, err := issuer.Issue("bob", alicePublic[:8]); err == nil {
+		t.Error("certified a malformed key")
+	}
+
+	// the name stays taken after a restart, under the same issuer key
+	reopened := openTestIssuer(t, dir)
+	if !reopened.PublicKey().Equal(issuer.PublicKey()) {
+		t.Error("the issuer's key changed on reopening")
+	}
+	if _, err := reopened.Issue("alice", mallory.Public().(ed25519.PublicKey)); err != ErrSenderTaken {
+		t.Errorf("certifying another key for alice after a restart = %v, want ErrSenderTaken", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	issuer := openTestIssuer(t, t.TempDir())
+	foreign := openTestIssuer(t, t.TempDir())
+	alice, mallory := newTestKey(t), newTestKey(t)
+	certify := func(issuer *KeyIssuer, sender string, key ed25519.PrivateKey) Certificate {
+		t.Helper()
+		cert, err := issuer.Issue(sender, key.Public().(ed25519.PublicKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	aliceCert := certify(issuer, "alice", alice)
+	malloryCert := certify(issuer, "mallory", mallory)
+
+	tests := []struct {
+		name   string
+		opts   []PublishOption
+		change func(msg *amqp.Delivery)
+		want   error
+	}{
+		{"genuine", []PublishOption{SignedBy(alice, aliceCert)}, nil, nil},
+		{"unsigned", []PublishOption{WithSender("alice")}, nil, ErrUnsigned},
+		{"foreign issuer", []PublishOption{SignedBy(alice, certify(foreign, "alice", alice))}, nil, ErrBadCertificate},
+		{"someone else's key", []PublishOption{SignedBy(mallory, aliceCert)}, nil, ErrBadSignature},
+		{"changed sender", []PublishOption{SignedBy(mallory, malloryCert)}, func(msg *amqp.Delivery) { msg.Headers[HeaderSender] = "alice" }, ErrBadCertificate},
+		{"changed message ID", []PublishOption{SignedBy(alice, aliceCert)}, func(msg *amqp.Delivery) { msg.MessageId = "replayed" }, ErrBadSignature},
+		{"changed type", []PublishOption{SignedBy(alice, aliceCert)}, func(msg *amqp.Delivery) { msg.Type = "other" }, ErrBadSignature},
+		{"changed body", []PublishOption{SignedBy(alice, aliceCert)}, func(msg *amqp.Delivery) { msg.Body = []byte(`{"Text":"retreat"}`) }, ErrBadSignature},
+		{"changed encoding", []PublishOption{SignedBy(alice, aliceCert)}, func(msg *amqp.Delivery) { msg.ContentEncoding = "gzip" }, ErrBadSignature},
+		{"forged signature", []PublishOption{SignedBy(alice, aliceCert)}, func(msg *amqp.Delivery) { msg.Headers[HeaderSignature] = "not base64!" }, ErrBadSignature},
+		{"garbled certificate", []PublishOption{SignedBy(alice, aliceCert)}, func(msg *amqp.Delivery) { msg.Headers[HeaderCertificate] = "e30=" }, ErrBadCertificate},
+		// the route isn't signed, so retries and requeues keep the signature
+		{"rerouted", []PublishOption{SignedBy(alice, aliceCert)}, func(msg *amqp.Delivery) { msg.RoutingKey = "elsewhere" }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := sent(t, note{Text: "attack at dawn"}, tt.opts...)
+			if tt.change != nil {
+				tt.change(&msg)
+			}
+			if err := Verify(msg, issuer.PublicKey()); !errors.Is(err, tt.want) {
+				t.Errorf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
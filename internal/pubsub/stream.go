@@ -0,0 +1,182 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderStreamOffset is both the consumer argument choosing where a stream
+// consumer starts and the header carrying each delivery's offset.
+const HeaderStreamOffset = "x-stream-offset"
+
+// StreamOffset is where a consumer starts reading a Stream queue. The zero
+// value starts with the next message published.
+type StreamOffset struct {
+	spec any
+}
+
+var (
+	// OffsetFirst starts with the oldest message the stream still keeps.
+	OffsetFirst = StreamOffset{"first"}
+	// OffsetLast starts with the most recent messages already in the stream.
+	OffsetLast = StreamOffset{"last"}
+	// OffsetNext starts with the next message published.
+	OffsetNext = StreamOffset{"next"}
+)
+
+// Offset starts with the message at offset n.
+func Offset(n int64) StreamOffset {
+	return StreamOffset{n}
+}
+
+// OffsetAt starts with the first message appended at or after t.
+func OffsetAt(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+// ConsumeArgs are the arguments to Consume a stream from o.
+func (o StreamOffset) ConsumeArgs() amqp.Table {
+	if o.spec == nil {
+		return nil
+	}
+	return amqp.Table{HeaderStreamOffset: o.spec}
+}
+
+func (o StreamOffset) String() string {
+	switch spec := o.spec.(type) {
+	case nil:
+		return "next"
+	case time.Time:
+		return spec.Format(time.RFC3339)
+	}
+	return fmt.Sprint(o.spec)
+}
+
+// OffsetOf reports the stream offset of a delivery from a Stream queue.
+func OffsetOf(meta Metadata) (int64, bool) {
+	return tableInt(meta.Headers[HeaderStreamOffset])
+}
+
+// WithStreamOffset starts consuming a Stream queue from offset, unless the
+// subscription's OffsetStore says how far it already got.
+func WithStreamOffset(offset StreamOffset) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.offset = offset
+	}
+}
+
+// OffsetStore remembers how far subscriptions have read their streams, so
+// they carry on from there when restarted.
+type OffsetStore interface {
+	// Load returns the last offset saved for queue, if any.
+	Load(queue string) (offset int64, ok bool, err error)
+	Save(queue string, offset int64) error
+}
+
+// WithOffsetStore saves the offset of the last message handled from a
+// Stream queue to store, and resumes from the message after it. With
+// several workers, it is the last offset before which every message has
+// been handled.
+func WithOffsetStore(store OffsetStore) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.offsets = store
+	}
+}
+
+// FileOffsetStore keeps offsets in a JSON file, rewriting it on every save.
+type FileOffsetStore struct {
+	path string
+
+	mu      sync.Mutex
+	offsets map[string]int64
+}
+
+// OpenFileOffsetStore loads the offsets saved in path, which is created on
+// the first save.
+func OpenFileOffsetStore(path string) (*FileOffsetStore, error) {
+	s := &FileOffsetStore{path: path, offsets: map[string]int64{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.offsets); err != nil {
+		return nil, fmt.Errorf("could not read offsets from %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *FileOffsetStore) Load(queue string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, ok := s.offsets[queue]
+	return offset, ok, nil
+}
+
+func (s *FileOffsetStore) Save(queue string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsets[queue] = offset
+	data, err := json.Marshal(s.offsets)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// offsetTracker follows the offsets a stream subscription has handled.
+// Workers may finish out of order, so an offset only counts as handled once
+// every offset dispatched before it is too.
+type offsetTracker struct {
+	mu        sync.Mutex
+	handled   int64
+	ok        bool
+	inflight  []int64
+	completed map[int64]bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{completed: map[int64]bool{}}
+}
+
+// last returns the last offset handled so far.
+func (t *offsetTracker) last() (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.handled, t.ok
+}
+
+// dispatched records that offset was handed to a worker.
+func (t *offsetTracker) dispatched(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.inflight = append(t.inflight, offset)
+}
+
+// done records that offset was handled, calling save with the new last
+// handled offset if it moved.
+func (t *offsetTracker) done(offset int64, save func(int64)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.completed[offset] = true
+	moved := false
+	for len(t.inflight) > 0 && t.completed[t.inflight[0]] {
+		delete(t.completed, t.inflight[0])
+		t.handled, t.ok, moved = t.inflight[0], true, true
+		t.inflight = t.inflight[1:]
+	}
+	if moved {
+		save(t.handled)
+	}
+}
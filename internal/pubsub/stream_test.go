@@ -0,0 +1,254 @@
+package pubsub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamOf declares the stream "log", bound to amq.direct, on a new memory
+// broker.
+func streamOf(t *testing.T) *MemoryConnection {
+	t.Helper()
+	conn := NewMemoryBroker().Connect()
+	err := Topology{
+		Queues:   []QueueSpec{QueueOf("log", Stream)},
+		Bindings: []BindingSpec{{Queue: "log", Exchange: "amq.direct", Key: "log"}},
+	}.Declare(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func appendLogs(t *testing.T, conn *MemoryConnection, values ...int) {
+	t.Helper()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	for _, v := range values {
+		if err := Publish(ch, "amq.direct", "log", ContentTypeJSON, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readLog subscribes to the stream until want messages have been handled,
+// returning their offsets in the order they were handled.
+func readLog(t *testing.T, conn *MemoryConnection, want int, opts ...SubscribeOption) []int64 {
+	t.Helper()
+	handled := make(chan int64, want+10)
+	sub, err := SubscribeHandler(context.Background(), conn, "amq.direct", "log", "log", Stream,
+		func(_ context.Context, _ int, meta Metadata) (AckType, error) {
+			offset, _ := OffsetOf(meta)
+			handled <- offset
+			return Ack, nil
+		},
+		opts...,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	for len(offsets) < want {
+		select {
+		case offset := <-handled:
+			offsets = append(offsets, offset)
+		case <-time.After(time.Second):
+			t.Fatalf("handled offsets %v, then nothing", offsets)
+		}
+	}
+	sub.Close()
+	select {
+	case offset := <-handled:
+		t.Fatalf("handled offset %d after %v", offset, offsets)
+	default:
+	}
+	return offsets
+}
+
+func TestStreamSubscriptionStart(t *testing.T) {
+	conn := streamOf(t)
+	appendLogs(t, conn, 0, 1, 2)
+	time.Sleep(5 * time.Millisecond)
+	mark := time.Now()
+	appendLogs(t, conn, 3, 4)
+
+	tests := []struct {
+		name   string
+		offset StreamOffset
+		want   []int64
+	}{
+		{"first", OffsetFirst, []int64{0, 1, 2, 3, 4}},
+		{"last", OffsetLast, []int64{4}},
+		{"offset", Offset(2), []int64{2, 3, 4}},
+		{"timestamp", OffsetAt(mark), []int64{3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := readLog(t, conn, len(tt.want), WithStreamOffset(tt.offset))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("read offsets %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("next", func(t *testing.T) {
+		ch, err := conn.Channel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ch.Close()
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			if err := Publish(ch, "amq.direct", "log", ContentTypeJSON, 5); err != nil {
+				t.Error(err)
+			}
+		}()
+		if got := readLog(t, conn, 1, WithStreamOffset(OffsetNext)); !slices.Equal(got, []int64{5}) {
+			t.Errorf("read offsets %v, want [5]", got)
+		}
+	})
+}
+
+func TestOffsetTrackerWaitsForEarlierOffsets(t *testing.T) {
+	tracker := newOffsetTracker()
+	for offset := int64(10); offset < 15; offset++ {
+		tracker.dispatched(offset)
+	}
+	var saved []int64
+	save := func(last int64) { saved = append(saved, last) }
+
+	for _, step := range []struct {
+		done int64
+		last int64
+		ok   bool
+	}{
+		{12, 0, false},
+		{11, 0, false},
+		{10, 12, true},
+		{14, 12, true},
+		{13, 14, true},
+	} {
+		tracker.done(step.done, save)
+		if last, ok := tracker.last(); last != step.last || ok != step.ok {
+			t.Errorf("after %d, last = %d, %v; want %d, %v", step.done, last, ok, step.last, step.ok)
+		}
+	}
+	if want := []int64{12, 14}; !slices.Equal(saved, want) {
+		t.Errorf("saved %v, want %v", saved, want)
+	}
+}
+
+// memOffsets is an OffsetStore recording every save.
+type memOffsets struct {
+	mu    sync.Mutex
+	saved []int64
+}
+
+func (s *memOffsets) Load(string) (int64, bool, error) { return 0, false, nil }
+
+func (s *memOffsets) Save(_ string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved = append(s.saved, offset)
+	return nil
+}
+
+func (s *memOffsets) last() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.saved) == 0 {
+		return -1
+	}
+	return s.saved[len(s.saved)-1]
+}
+
+func TestStreamWorkersSaveOffsetsInOrder(t *testing.T) {
+	conn := streamOf(t)
+	appendLogs(t, conn, 0, 1, 2, 3)
+
+	store := &memOffsets{}
+	release := make(chan struct{})
+	done := make(chan int64, 4)
+	sub, err := SubscribeHandler(context.Background(), conn, "amq.direct", "log", "log", Stream,
+		func(_ context.Context, v int, meta Metadata) (AckType, error) {
+			if v == 1 {
+				<-release
+			}
+			offset, _ := OffsetOf(meta)
+			done <- offset
+			return Ack, nil
+		},
+		WithStreamOffset(OffsetFirst),
+		WithOffsetStore(store),
+		WithWorkers(4),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("workers are stuck behind the slow message")
+		}
+	}
+	if last := store.last(); last != 0 {
+		t.Errorf("saved offset %d while offset 1 was still being handled", last)
+	}
+	close(release)
+	<-done
+	for deadline := time.Now().Add(time.Second); store.last() != 3 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if last := store.last(); last != 3 {
+		t.Errorf("saved offset %d once everything was handled, want 3", last)
+	}
+}
+
+func TestFileOffsetStoreResumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offsets.json")
+	conn := streamOf(t)
+	appendLogs(t, conn, 0, 1, 2)
+
+	store, err := OpenFileOffsetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readLog(t, conn, 3, WithStreamOffset(OffsetFirst), WithOffsetStore(store)); !slices.Equal(got, []int64{0, 1, 2}) {
+		t.Fatalf("first run read %v", got)
+	}
+
+	// a restarted process opens the store again and carries on, ignoring
+	// its start offset
+	appendLogs(t, conn, 3, 4)
+	store, err = OpenFileOffsetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last, ok, err := store.Load("log"); err != nil || !ok || last != 2 {
+		t.Fatalf("Load = %d, %v, %v; want 2", last, ok, err)
+	}
+	if got := readLog(t, conn, 2, WithStreamOffset(OffsetFirst), WithOffsetStore(store)); !slices.Equal(got, []int64{3, 4}) {
+		t.Errorf("second run read %v, want [3 4]", got)
+	}
+}
+
+func TestOpenFileOffsetStoreRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offsets.json")
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileOffsetStore(path); err == nil {
+		t.Error("opened a corrupt offsets file")
+	}
+}
@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// Subscription is a running consumer started by Subscribe.
+type Subscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Close cancels the consumer and waits for deliveries already received to be
+// handled.
+func (s *Subscription) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Wait blocks until the subscription has stopped, either because it was
+// closed, its context was cancelled or its broker went away for good.
+func (s *Subscription) Wait() {
+	<-s.done
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	onError     func(error)
+	codecs      *CodecRegistry
+	schemas     *SchemaRegistry
+	prefetch    int
+	workers     int
+	orderByKey  bool
+	retry       *RetryPolicy
+	dedup       DedupStore
+	middleware  []any
+	queue       []QueueOption
+	offset      StreamOffset
+	offsets     OffsetStore
+	verifier    ed25519.PublicKey
+	decryptKeys KeyProvider
+	encrypted   bool
+}
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	options := subscribeOptions{
+		onError: func(err error) {
+			log.Println("Subscription error:", err)
+		},
+		codecs:   DefaultCodecs,
+		schemas:  DefaultSchemas,
+		prefetch: 10,
+		workers:  1,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithErrorHandler reports failures that don't stop the subscription, such
+// as failed acks or resubscribe attempts, to fn instead of the log.
+func WithErrorHandler(fn func(error)) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.onError = fn
+	}
+}
+
+var consumerSeq atomic.Uint64
+
+func consumerTag() string {
+	return fmt.Sprintf("peril-%d-%d", os.Getpid(), consumerSeq.Add(1))
+}
+
+// WithCodecs decodes deliveries with codecs instead of DefaultCodecs.
+func WithCodecs(codecs *CodecRegistry) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.codecs = codecs
+	}
+}
+
+// WithPrefetch limits how many unacknowledged deliveries the broker sends
+// the subscription at once. It should be at least the number of workers.
+func WithPrefetch(count int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = count
+	}
+}
+
+// WithWorkers handles up to n deliveries concurrently. Deliveries may then be
+// handled out of order unless WithKeyOrdering is also set.
+func WithWorkers(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.workers = n
+	}
+}
+
+// WithKeyOrdering keeps deliveries with the same routing key in order when
+// handled by several workers.
+func WithKeyOrdering() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderByKey = true
+	}
+}
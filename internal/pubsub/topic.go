@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Topic describes the messages of type T published to Exchange: their
+// routing key and how they are encoded. Publishing and subscribing through
+// a Topic rather than by hand means the payload type is checked by the
+// compiler and publishers can't pick a codec subscribers don't expect.
+type Topic[T any] struct {
+	Exchange string
+	// Key is the routing key template. Words written as {name} are filled
+	// in from Params when publishing and match any word when subscribing,
+	// so they only make sense on topic exchanges.
+	Key         string
+	ContentType string
+}
+
+// Params fill in the {name} words of a Topic's key.
+type Params map[string]string
+
+// RoutingKey is the key to publish with for params. Every placeholder
+// needs a value, and every value a placeholder, though a placeholder may
+// appear more than once. Values must be non-empty and can't contain '.',
+// '*' or '#', which would change how the key is matched.
+func (t Topic[T]) RoutingKey(params Params) (string, error) {
+	words := strings.Split(t.Key, ".")
+	used := map[string]bool{}
+	for i, w := range words {
+		name, ok := placeholder(w)
+		if !ok {
+			continue
+		}
+		value, ok := params[name]
+		if !ok {
+			return "", fmt.Errorf("no value for {%s} in key %q", name, t.Key)
+		}
+		if err := validParam(value); err != nil {
+			return "", fmt.Errorf("invalid value for {%s} in key %q: %w", name, t.Key, err)
+		}
+		words[i] = value
+		used[name] = true
+	}
+	if len(used) < len(params) {
+		var extra []string
+		for name := range params {
+			if !used[name] {
+				extra = append(extra, name)
+			}
+		}
+		sort.Strings(extra)
+		return "", fmt.Errorf("key %q has no placeholder for %s", t.Key, strings.Join(extra, ", "))
+	}
+	return strings.Join(words, "."), nil
+}
+
+// BindingKey is the key that binds a queue to every message of the topic.
+func (t Topic[T]) BindingKey() string {
+	words := strings.Split(t.Key, ".")
+	for i, w := range words {
+		if _, ok := placeholder(w); ok {
+			words[i] = "*"
+		}
+	}
+	return strings.Join(words, ".")
+}
+
+func validParam(value string) error {
+	if value == "" {
+		return errors.New("empty value")
+	}
+	if i := strings.IndexAny(value, ".*#"); i >= 0 {
+		return fmt.Errorf("%q contains %q", value, value[i])
+	}
+	return nil
+}
+
+func placeholder(word string) (string, bool) {
+	if len(word) > 2 && word[0] == '{' && word[len(word)-1] == '}' {
+		return word[1 : len(word)-1], true
+	}
+	return "", false
+}
+
+// Publish sends value on the topic with the routing key for params.
+func (t Topic[T]) Publish(pub Publisher, params Params, value T, opts ...PublishOption) error {
+	key, err := t.RoutingKey(params)
+	if err != nil {
+		return err
+	}
+	return Publish(pub, t.Exchange, key, t.ContentType, value, opts...)
+}
+
+// Subscribe binds queueName to every message of the topic and handles them
+// like SubscribeHandler. Only messages in the topic's content type are
+// decoded; others are dead-lettered.
+func (t Topic[T]) Subscribe(
+	ctx context.Context,
+	broker Broker,
+	queueName string,
+	queueType SimpleQueueType,
+	handler Handler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	codec, ok := DefaultCodecs.Lookup(t.ContentType)
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type %q", t.ContentType)
+	}
+	opts = append([]SubscribeOption{WithCodecs(NewCodecRegistry(codec))}, opts...)
+	return SubscribeHandler(ctx, broker, t.Exchange, queueName, t.BindingKey(), queueType, handler, opts...)
+}
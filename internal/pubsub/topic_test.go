@@ -0,0 +1,53 @@
+package pubsub
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoutingKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		params  Params
+		want    string
+		wantErr string
+	}{
+		{"army_moves.{username}", Params{"username": "alice"}, "army_moves.alice", ""},
+		{"pause", nil, "pause", ""},
+		{"war.{attacker}.{defender}", Params{"attacker": "alice", "defender": "bob"}, "war.alice.bob", ""},
+		{"a.{u}.{u}", Params{"u": "alice"}, "a.alice.alice", ""},
+		{"war.{attacker}.{defender}", Params{"attacker": "alice"}, "", "no value for {defender}"},
+		{"army_moves.{username}", Params{"username": "alice", "extra": "x"}, "", "no placeholder for extra"},
+		{"a.{u}.{u}", Params{"u": "alice", "extra": "x"}, "", "no placeholder for extra"},
+		{"pause", Params{"b": "x", "a": "y"}, "", "no placeholder for a, b"},
+		// a word that only contains a name isn't a placeholder
+		{"a.x{u}y", Params{"u": "alice"}, "", "no placeholder for u"},
+		{"army_moves.{username}", Params{"username": ""}, "", "empty value"},
+		{"army_moves.{username}", Params{"username": "alice.bob"}, "", `contains '.'`},
+		{"army_moves.{username}", Params{"username": "#"}, "", `contains '#'`},
+	}
+	for _, tt := range tests {
+		got, err := Topic[note]{Exchange: "peril_topic", Key: tt.key}.RoutingKey(tt.params)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("RoutingKey(%q, %v) = %q, %v; want an error containing %q", tt.key, tt.params, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("RoutingKey(%q, %v) = %q, %v; want %q", tt.key, tt.params, got, err, tt.want)
+		}
+	}
+}
+
+func TestBindingKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"army_moves.{username}":     "army_moves.*",
+		"war.{attacker}.{defender}": "war.*.*",
+		"pause":                     "pause",
+	} {
+		if got := (Topic[note]{Key: key}).BindingKey(); got != want {
+			t.Errorf("BindingKey of %q = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Topology describes exchanges, queues and the bindings between them.
+// Declaring it is idempotent, and brokers that reconnect redeclare it on
+// every new connection.
+type Topology struct {
+	Exchanges []ExchangeSpec `json:"exchanges,omitempty"`
+	Queues    []QueueSpec    `json:"queues,omitempty"`
+	Bindings  []BindingSpec  `json:"bindings,omitempty"`
+}
+
+type ExchangeSpec struct {
+	Name       string     `json:"name"`
+	Kind       string     `json:"kind"`
+	Durable    bool       `json:"durable,omitempty"`
+	AutoDelete bool       `json:"auto_delete,omitempty"`
+	Internal   bool       `json:"internal,omitempty"`
+	Args       amqp.Table `json:"args,omitempty"`
+}
+
+type QueueSpec struct {
+	Name       string     `json:"name"`
+	Durable    bool       `json:"durable,omitempty"`
+	AutoDelete bool       `json:"auto_delete,omitempty"`
+	Exclusive  bool       `json:"exclusive,omitempty"`
+	Args       amqp.Table `json:"args,omitempty"`
+}
+
+type BindingSpec struct {
+	Queue    string     `json:"queue"`
+	Exchange string     `json:"exchange"`
+	Key      string     `json:"key"`
+	Args     amqp.Table `json:"args,omitempty"`
+}
+
+// QueueOf describes the queue DeclareAndBind declares for queueType, which
+// dead-letters to DeadLetterExchange unless it is a Stream.
+func QueueOf(name string, queueType SimpleQueueType, opts ...QueueOption) QueueSpec {
+	q := QueueSpec{
+		Name:       name,
+		Durable:    queueType != Transient,
+		AutoDelete: queueType == Transient,
+		Exclusive:  queueType == Transient,
+		Args:       amqp.Table{},
+	}
+	switch queueType {
+	case Quorum, Stream:
+		q.Args["x-queue-type"] = string(queueType)
+	}
+	if queueType != Stream {
+		q.Args["x-dead-letter-exchange"] = DeadLetterExchange
+	}
+	for _, opt := range opts {
+		opt(&q)
+	}
+	return q
+}
+
+// DeadLetterTopology declares DeadLetterExchange as a fanout exchange with
+// the durable queue bound to it, so every dead letter ends up there.
+func DeadLetterTopology(queue string) Topology {
+	return Topology{
+		Exchanges: []ExchangeSpec{{Name: DeadLetterExchange, Kind: amqp.ExchangeFanout, Durable: true}},
+		Queues:    []QueueSpec{{Name: queue, Durable: true}},
+		Bindings:  []BindingSpec{{Queue: queue, Exchange: DeadLetterExchange}},
+	}
+}
+
+// WithAlternateExchange makes ae, a fanout exchange with the durable queue
+// bound to it, the alternate exchange of exchanges in t. Messages those
+// exchanges can't route to any queue end up in queue instead of being
+// dropped, so mandatory publishes to them are never returned.
+func (t Topology) WithAlternateExchange(ae, queue string, exchanges ...string) Topology {
+	t = t.Merge(Topology{
+		Exchanges: []ExchangeSpec{{Name: ae, Kind: amqp.ExchangeFanout, Durable: true}},
+		Queues:    []QueueSpec{{Name: queue, Durable: true}},
+		Bindings:  []BindingSpec{{Queue: queue, Exchange: ae}},
+	})
+	for i, e := range t.Exchanges {
+		if !slices.Contains(exchanges, e.Name) {
+			continue
+		}
+		args := amqp.Table{"alternate-exchange": ae}
+		for k, v := range e.Args {
+			if k != "alternate-exchange" {
+				args[k] = v
+			}
+		}
+		t.Exchanges[i].Args = args
+	}
+	return t
+}
+
+// LoadTopology reads a Topology from a JSON file. Whole numbers in
+// arguments are read as integers, as RabbitMQ expects for settings such as
+// x-message-ttl.
+func LoadTopology(path string) (Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+	var t Topology
+	if err := dec.Decode(&t); err != nil {
+		return Topology{}, fmt.Errorf("could not parse topology %s: %w", path, err)
+	}
+	for i := range t.Exchanges {
+		t.Exchanges[i].Args = normalizeArgs(t.Exchanges[i].Args)
+	}
+	for i := range t.Queues {
+		t.Queues[i].Args = normalizeArgs(t.Queues[i].Args)
+	}
+	for i := range t.Bindings {
+		t.Bindings[i].Args = normalizeArgs(t.Bindings[i].Args)
+	}
+	return t, nil
+}
+
+func normalizeArgs(args amqp.Table) amqp.Table {
+	for k, v := range args {
+		args[k] = normalizeArg(v)
+	}
+	return args
+}
+
+func normalizeArg(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		return normalizeArgs(amqp.Table(v))
+	case []any:
+		for i := range v {
+			v[i] = normalizeArg(v[i])
+		}
+		return v
+	}
+	return v
+}
+
+// Merge returns t with the declarations in other added, replacing those
+// with the same exchange name, queue name or binding.
+func (t Topology) Merge(other Topology) Topology {
+	merged := Topology{
+		Exchanges: append([]ExchangeSpec(nil), t.Exchanges...),
+		Queues:    append([]QueueSpec(nil), t.Queues...),
+		Bindings:  append([]BindingSpec(nil), t.Bindings...),
+	}
+exchanges:
+	for _, e := range other.Exchanges {
+		for i := range merged.Exchanges {
+			if merged.Exchanges[i].Name == e.Name {
+				merged.Exchanges[i] = e
+				continue exchanges
+			}
+		}
+		merged.Exchanges = append(merged.Exchanges, e)
+	}
+queues:
+	for _, q := range other.Queues {
+		for i := range merged.Queues {
+			if merged.Queues[i].Name == q.Name {
+				merged.Queues[i] = q
+				continue queues
+			}
+		}
+		merged.Queues = append(merged.Queues, q)
+	}
+bindings:
+	for _, b := range other.Bindings {
+		for i, mb := range merged.Bindings {
+			if mb.Queue == b.Queue && mb.Exchange == b.Exchange && mb.Key == b.Key {
+				merged.Bindings[i] = b
+				continue bindings
+			}
+		}
+		merged.Bindings = append(merged.Bindings, b)
+	}
+	return merged
+}
+
+// Declare declares the topology on broker: exchanges first, then queues,
+// then bindings.
+func (t Topology) Declare(broker Broker) error {
+	ch, err := broker.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := t.declare(ch); err != nil {
+		return err
+	}
+	if r, ok := broker.(topologyRecorder); ok {
+		r.recordTopology(t)
+	}
+	return nil
+}
+
+func (t Topology) declare(ch Channel) error {
+	for _, e := range t.Exchanges {
+		if err := ch.ExchangeDeclare(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, e.Args); err != nil {
+			return fmt.Errorf("could not declare exchange %s: %w", e.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := q.declare(ch); err != nil {
+			return err
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := b.declare(ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b BindingSpec) declare(ch Channel) error {
+	if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, b.Args); err != nil {
+		return fmt.Errorf("could not bind %s to %s with key %q: %w", b.Queue, b.Exchange, b.Key, err)
+	}
+	return nil
+}
+
+func (q QueueSpec) declare(ch Channel) (amqp.Queue, error) {
+	if err := q.Validate(); err != nil {
+		return amqp.Queue{}, err
+	}
+	queue, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args)
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("could not declare queue %s: %w", q.Name, err)
+	}
+	return queue, nil
+}
+
+// TopologyDiff is an exchange or queue that doesn't match its description.
+type TopologyDiff struct {
+	Kind    string // "exchange" or "queue"
+	Name    string
+	Problem string
+}
+
+func (d TopologyDiff) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Name, d.Problem)
+}
+
+// Diff compares the topology with what exists on broker without changing
+// anything. It reports missing exchanges and queues, and those declared
+// with different properties or arguments. AMQP offers no way to list
+// bindings, so they aren't compared. Exclusive queues owned by another
+// connection can't be inspected and are assumed to match.
+func (t Topology) Diff(broker Broker) ([]TopologyDiff, error) {
+	var ch Channel
+	defer func() {
+		if ch != nil {
+			ch.Close()
+		}
+	}()
+	// A failed check closes the channel, so each check gets a fresh one
+	// when needed.
+	check := func(f func(Channel) error) (*amqp.Error, error) {
+		if ch == nil {
+			var err error
+			if ch, err = broker.Channel(); err != nil {
+				return nil, err
+			}
+		}
+		err := f(ch)
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) {
+			switch amqpErr.Code {
+			case amqp.NotFound, amqp.PreconditionFailed, amqp.ResourceLocked:
+				ch = nil
+				return amqpErr, nil
+			}
+		}
+		return nil, err
+	}
+
+	var diffs []TopologyDiff
+	for _, e := range t.Exchanges {
+		amqpErr, err := check(func(ch Channel) error {
+			if err := ch.ExchangeDeclarePassive(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, e.Args); err != nil {
+				return err
+			}
+			return ch.ExchangeDeclare(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, e.Args)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := diffFor("exchange", e.Name, amqpErr); ok {
+			diffs = append(diffs, d)
+		}
+	}
+	for _, q := range t.Queues {
+		amqpErr, err := check(func(ch Channel) error {
+			if _, err := ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args); err != nil {
+				return err
+			}
+			_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Args)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := diffFor("queue", q.Name, amqpErr); ok {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+func diffFor(kind, name string, err *amqp.Error) (TopologyDiff, bool) {
+	if err == nil {
+		return TopologyDiff{}, false
+	}
+	switch err.Code {
+	case amqp.NotFound:
+		return TopologyDiff{Kind: kind, Name: name, Problem: "missing"}, true
+	case amqp.ResourceLocked:
+		return TopologyDiff{}, false
+	}
+	return TopologyDiff{Kind: kind, Name: name, Problem: "differs: " + err.Reason}, true
+}
+
+// RetireQueues replaces queues that can't be redeclared in place, for
+// example to change their type. It removes bindings so nothing new reaches
+// the queues, then republishes the messages left in each to the route they
+// were first published with and deletes it, returning how many messages
+// were moved. Queues and bindings that don't exist are skipped, so it is
+// safe to run every time a process starts.
+func RetireQueues(broker Broker, queues []string, bindings []BindingSpec) (int, error) {
+	for _, b := range bindings {
+		err := withChannel(broker, func(ch Channel) error {
+			return ch.QueueUnbind(b.Queue, b.Key, b.Exchange, b.Args)
+		})
+		if err != nil && !isNotFound(err) {
+			return 0, fmt.Errorf("could not unbind %s from %s: %w", b.Queue, b.Exchange, err)
+		}
+	}
+
+	pub := NewConfirmingPublisher(broker, 5*time.Second)
+	defer pub.Close()
+	moved := 0
+	for _, queue := range queues {
+		err := withChannel(broker, func(ch Channel) error {
+			for {
+				msg, ok, err := ch.Get(queue, false)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					break
+				}
+				restoreRoute(&msg)
+				if err := pub.PublishWithContext(context.Background(), msg.Exchange, msg.RoutingKey, false, false, deliveryPublishing(msg)); err != nil {
+					msg.Nack(false, true)
+					return fmt.Errorf("could not move message %s: %w", msg.MessageId, err)
+				}
+				if err := msg.Ack(false); err != nil {
+					return err
+				}
+				moved++
+			}
+			_, err := ch.QueueDelete(queue, false, true, false)
+			return err
+		})
+		if err != nil && !isNotFound(err) {
+			return moved, fmt.Errorf("could not retire queue %s: %w", queue, err)
+		}
+	}
+	return moved, nil
+}
+
+// withChannel runs fn on a channel of its own, as a failed operation closes
+// the channel it ran on.
+func withChannel(broker Broker, fn func(Channel) error) error {
+	ch, err := broker.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+func isNotFound(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound
+}
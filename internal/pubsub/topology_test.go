@@ -0,0 +1,147 @@
+package pubsub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetireQueues(t *testing.T) {
+	mb := NewMemoryBroker()
+	conn := mb.Connect()
+	old := BindingSpec{Queue: "moves", Exchange: "amq.topic", Key: "army_moves.*"}
+	err := Topology{Queues: []QueueSpec{QueueOf("moves", Durable)}, Bindings: []BindingSpec{old}}.Declare(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := memChannelOf(t, mb)
+	publishTo(t, ch, "amq.topic", "army_moves.alice", "1")
+	publishTo(t, ch, "amq.topic", "army_moves.bob", "2")
+	// a retried message waits in the queue it came from, sent there through
+	// the default exchange, but belongs on its original route
+	err = ch.PublishWithContext(context.Background(), "", "moves", false, false, amqp.Publishing{
+		Body:    []byte("3"),
+		Headers: amqp.Table{HeaderOriginalExchange: "amq.topic", HeaderOriginalRoutingKey: "army_moves.carol"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a quorum queue replaces it, bound to the same key
+	err = Topology{
+		Queues:   []QueueSpec{QueueOf("moves.quorum", Quorum)},
+		Bindings: []BindingSpec{{Queue: "moves.quorum", Exchange: "amq.topic", Key: "army_moves.*"}},
+	}.Declare(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := RetireQueues(conn, []string{"moves"}, []BindingSpec{old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 3 {
+		t.Errorf("moved %d messages, want 3", moved)
+	}
+	var got []string
+	for {
+		msg, ok, err := ch.Get("moves.quorum", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		got = append(got, string(msg.Body)+" "+msg.RoutingKey)
+	}
+	if want := []string{"1 army_moves.alice", "2 army_moves.bob", "3 army_moves.carol"}; !slices.Equal(got, want) {
+		t.Errorf("moves.quorum holds %q, want %q", got, want)
+	}
+	if _, err := ch.QueueDeclarePassive("moves", true, false, false, false, nil); !isNotFound(err) {
+		t.Errorf("moves wasn't deleted: %v", err)
+	}
+
+	// on the next start there is nothing left to retire
+	if moved, err := RetireQueues(conn, []string{"moves"}, []BindingSpec{old}); err != nil || moved != 0 {
+		t.Errorf("second RetireQueues = %d, %v; want 0, nil", moved, err)
+	}
+}
+
+func TestLoadTopology(t *testing.T) {
+	topology, err := LoadTopology(filepath.Join("testdata", "topology.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topology.Exchanges) != 2 || len(topology.Queues) != 3 || len(topology.Bindings) != 3 {
+		t.Fatalf("loaded %+v", topology)
+	}
+	// RabbitMQ refuses TTLs and lengths that aren't integers
+	moves := topology.Queues[0]
+	if moves.Args["x-message-ttl"] != int64(60000) || moves.Args["x-max-length"] != int64(1000) {
+		t.Errorf("army_moves args = %#v", moves.Args)
+	}
+	if topology.Exchanges[0].Args["alternate-exchange"] != "peril_unroutable" {
+		t.Errorf("peril_topic args = %#v", topology.Exchanges[0].Args)
+	}
+	if err := topology.Declare(NewMemoryBroker().Connect()); err != nil {
+		t.Errorf("declaring the loaded topology: %v", err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "topology.json")
+	if err := os.WriteFile(bad, []byte(`{"queues": [{"name": "moves", "durible": true}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTopology(bad); err == nil {
+		t.Error("loaded a topology with a misspelt field")
+	}
+}
+
+func TestTopologyDiff(t *testing.T) {
+	topology, err := LoadTopology(filepath.Join("testdata", "topology.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the broker has war missing and army_moves with a different TTL
+	deployed := Topology{Exchanges: topology.Exchanges, Bindings: topology.Bindings[:1]}
+	for _, q := range topology.Queues {
+		switch q.Name {
+		case "war":
+			continue
+		case "army_moves":
+			q.Args = cloneTable(q.Args)
+			q.Args["x-message-ttl"] = int64(30000)
+		}
+		deployed.Queues = append(deployed.Queues, q)
+	}
+	conn := NewMemoryBroker().Connect()
+	if err := deployed.Declare(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := topology.Diff(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.String())
+	}
+	want := []string{
+		"queue army_moves: differs: PRECONDITION_FAILED - inequivalent arg 'x-message-ttl' for queue 'army_moves'",
+		"queue war: missing",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Diff = %q, want %q", got, want)
+	}
+
+	// Diff only looks
+	if _, err := memChannelOf(t, conn.broker).QueueDeclarePassive("war", true, false, false, false, nil); !isNotFound(err) {
+		t.Errorf("Diff declared war: %v", err)
+	}
+	if err := topology.Declare(conn); err == nil {
+		t.Error("redeclared army_moves with a different TTL")
+	}
+}
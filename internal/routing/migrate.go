@@ -0,0 +1,38 @@
+package routing
+
+import (
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// Queues declared by earlier versions of Peril. RabbitMQ won't change the
+// type of an existing queue, so the quorum queue and stream that replaced
+// them have new names.
+const (
+	LegacyWarQueue     = "war"
+	LegacyGameLogQueue = "game_logs"
+)
+
+// ClientRetryPolicy bounds how often a nacked move or war is redelivered
+// before it is dead-lettered. Wars are skipped by every client not involved
+// in them, so they may go round many times before reaching one that is.
+var ClientRetryPolicy = pubsub.RetryPolicy{
+	MaxAttempts: 10,
+	MaxSkips:    1000,
+	Backoff:     pubsub.Backoff{Min: 250 * time.Millisecond, Max: 10 * time.Second},
+}
+
+// RetireLegacyQueues moves what is left in the legacy queues, including wars
+// waiting in their retry queues, to WarQueue and GameLogStream and deletes
+// them. Those must already be declared, so clients, which declare both, run
+// it after declaring their topology.
+func RetireLegacyQueues(broker pubsub.Broker) (int, error) {
+	// Drain the retry queues first, so nothing expires back into the war
+	// queue once it has been drained.
+	queues := append(ClientRetryPolicy.Queues(LegacyWarQueue), LegacyWarQueue, LegacyGameLogQueue)
+	return pubsub.RetireQueues(broker, queues, []pubsub.BindingSpec{
+		{Queue: LegacyWarQueue, Exchange: ExchangePerilTopic, Key: WarRecognitionsPrefix + ".*"},
+		{Queue: LegacyGameLogQueue, Exchange: ExchangePerilTopic, Key: GameLogSlug + ".*"},
+	})
+}
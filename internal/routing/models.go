@@ -1,13 +1,45 @@
 package routing
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
 
 type PlayingState struct {
 	IsPaused bool
 }
 
+// KeyRequest asks the server to certify the public key a player signs
+// messages with, proving the player holds its private half.
+type KeyRequest struct {
+	Claim pubsub.KeyClaim
+}
+
+// PlayerKey is the server's answer to a KeyRequest. Issuer is the key the
+// server certifies with, which checks every player's certificate. LogKey
+// encrypts the player's game logs, which only the server can then read. It
+// is sealed to the request's claim.
+type PlayerKey struct {
+	Certificate pubsub.Certificate
+	Issuer      []byte
+	LogKey      []byte
+}
+
 type GameLog struct {
 	CurrentTime time.Time
 	Message     string
 	Username    string
 }
+
+// CheckGameLog checks that gl, delivered with meta, was sent by the player it
+// is about, to that player's routing key. The sender must have been verified.
+func CheckGameLog(gl GameLog, meta pubsub.Metadata) error {
+	route := strings.TrimPrefix(meta.RoutingKey, GameLogSlug+".")
+	if gl.Username != meta.Sender || route != meta.Sender {
+		return fmt.Errorf("%s sent a log as %s to %s", meta.Sender, gl.Username, route)
+	}
+	return nil
+}
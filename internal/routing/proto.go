@@ -0,0 +1,48 @@
+package routing
+
+import (
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/protoutil"
+)
+
+// Protocol Buffers encoding of the messages in routing.proto.
+
+func (ps PlayingState) MarshalProto() ([]byte, error) {
+	return protoutil.AppendBool(nil, 1, ps.IsPaused), nil
+}
+
+func (ps *PlayingState) UnmarshalProto(b []byte) error {
+	*ps = PlayingState{}
+	return protoutil.Range(b, func(f protoutil.Field) error {
+		if f.Num == 1 {
+			ps.IsPaused = f.Varint != 0
+		}
+		return nil
+	})
+}
+
+func (gl GameLog) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = protoutil.AppendTimestamp(b, 1, gl.CurrentTime)
+	b = protoutil.AppendString(b, 2, gl.Message)
+	b = protoutil.AppendString(b, 3, gl.Username)
+	return b, nil
+}
+
+func (gl *GameLog) UnmarshalProto(b []byte) error {
+	*gl = GameLog{}
+	return protoutil.Range(b, func(f protoutil.Field) error {
+		switch f.Num {
+		case 1:
+			t, err := protoutil.ParseTimestamp(f.Bytes)
+			if err != nil {
+				return err
+			}
+			gl.CurrentTime = t
+		case 2:
+			gl.Message = string(f.Bytes)
+		case 3:
+			gl.Username = string(f.Bytes)
+		}
+		return nil
+	})
+}
@@ -8,9 +8,23 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	PlayingStateKey = "playing_state"
+
+	PlayerKeyKey = "player_key"
 )
 
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
 )
+
+// DeadLetterQueue collects everything dead-lettered to pubsub.DeadLetterExchange.
+const DeadLetterQueue = "peril_dlq"
+
+// Where messages no queue received are collected when the exchanges are
+// declared WithUnroutableQueue.
+const (
+	UnroutableExchange = "peril_unroutable"
+	UnroutableQueue    = "peril_unroutable"
+)
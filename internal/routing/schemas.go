@@ -0,0 +1,15 @@
+package routing
+
+import "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+
+// Current schema versions. When a message changes shape, keep its old
+// definition, bump the version here and register a pubsub.Upcast from the
+// old version so messages from older clients still decode.
+func init() {
+	pubsub.RegisterSchema[PlayingState](pubsub.DefaultSchemas, 1)
+	pubsub.RegisterSchema[GameLog](pubsub.DefaultSchemas, 1)
+	// Version 1 of KeyRequest carried a bare public key, which anyone could
+	// copy from a certificate, so it is refused rather than upcast.
+	pubsub.RegisterSchema[KeyRequest](pubsub.DefaultSchemas, 2)
+	pubsub.RegisterSchema[PlayerKey](pubsub.DefaultSchemas, 1)
+}
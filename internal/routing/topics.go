@@ -0,0 +1,18 @@
+package routing
+
+import "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+
+// Topics of the messages the server and clients publish. Game logs are keyed
+// by the username of the player they are about.
+var (
+	GameLogs = pubsub.Topic[GameLog]{
+		Exchange:    ExchangePerilTopic,
+		Key:         GameLogSlug + ".{username}",
+		ContentType: pubsub.ContentTypeGob,
+	}
+	Pause = pubsub.Topic[PlayingState]{
+		Exchange:    ExchangePerilDirect,
+		Key:         PauseKey,
+		ContentType: pubsub.ContentTypeJSON,
+	}
+)
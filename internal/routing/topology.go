@@ -0,0 +1,78 @@
+package routing
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// Queue names. Client queues are suffixed with the player's username.
+const (
+	GameLogStream        = "game_log_stream"
+	PlayingStateQueue    = "playing_state"
+	PlayerKeyQueue       = "player_key"
+	WarQueue             = "war.quorum"
+	PauseQueuePrefix     = "pause"
+	ArmyMovesQueuePrefix = "army_moves"
+)
+
+// Exchanges declares the exchanges every Peril process publishes to.
+func Exchanges() pubsub.Topology {
+	return pubsub.Topology{
+		Exchanges: []pubsub.ExchangeSpec{
+			{Name: ExchangePerilDirect, Kind: amqp.ExchangeDirect, Durable: true},
+			{Name: ExchangePerilTopic, Kind: amqp.ExchangeTopic, Durable: true},
+		},
+	}.Merge(pubsub.DeadLetterTopology(DeadLetterQueue))
+}
+
+// WithUnroutableQueue makes the Peril exchanges send messages no queue
+// receives to UnroutableQueue. Every process must agree on it, as RabbitMQ
+// won't redeclare an exchange with a different alternate exchange.
+func WithUnroutableQueue(t pubsub.Topology) pubsub.Topology {
+	return t.WithAlternateExchange(UnroutableExchange, UnroutableQueue, ExchangePerilDirect, ExchangePerilTopic)
+}
+
+// GameLogRetention is how long the game log stream keeps logs for replay.
+const GameLogRetention = 30 * 24 * time.Hour
+
+func gameLogStream() pubsub.QueueSpec {
+	return pubsub.QueueOf(GameLogStream, pubsub.Stream, pubsub.WithMaxAge(GameLogRetention))
+}
+
+// ServerTopology is everything the server declares at startup.
+func ServerTopology() pubsub.Topology {
+	return Exchanges().Merge(pubsub.Topology{
+		Queues: []pubsub.QueueSpec{
+			gameLogStream(),
+			pubsub.QueueOf(PlayingStateQueue, pubsub.Durable),
+			pubsub.QueueOf(PlayerKeyQueue, pubsub.Durable),
+		},
+		Bindings: []pubsub.BindingSpec{
+			{Queue: GameLogStream, Exchange: ExchangePerilTopic, Key: GameLogSlug + ".*"},
+			{Queue: PlayingStateQueue, Exchange: ExchangePerilDirect, Key: PlayingStateKey},
+			{Queue: PlayerKeyQueue, Exchange: ExchangePerilDirect, Key: PlayerKeyKey},
+		},
+	})
+}
+
+// ClientTopology is everything a client playing as username declares at
+// startup.
+func ClientTopology(username string) pubsub.Topology {
+	return Exchanges().Merge(pubsub.Topology{
+		Queues: []pubsub.QueueSpec{
+			gameLogStream(),
+			pubsub.QueueOf(WarQueue, pubsub.Quorum),
+			pubsub.QueueOf(PauseQueuePrefix+"."+username, pubsub.Transient),
+			pubsub.QueueOf(ArmyMovesQueuePrefix+"."+username, pubsub.Transient),
+		},
+		Bindings: []pubsub.BindingSpec{
+			{Queue: GameLogStream, Exchange: ExchangePerilTopic, Key: GameLogSlug + ".*"},
+			{Queue: WarQueue, Exchange: ExchangePerilTopic, Key: WarRecognitionsPrefix + ".*"},
+			{Queue: PauseQueuePrefix + "." + username, Exchange: ExchangePerilDirect, Key: PauseKey},
+			{Queue: ArmyMovesQueuePrefix + "." + username, Exchange: ExchangePerilTopic, Key: ArmyMovesPrefix + ".*"},
+		},
+	})
+}